@@ -1,11 +1,10 @@
 module github.com/last9/last9-cdk/go
 
-go 1.17
+go 1.21
 
 require (
 	github.com/go-chi/chi/v5 v5.0.7
 	github.com/gorilla/mux v1.8.0
-	github.com/last9/last9-cdk/go/proc v0.0.0-20211209093125-ceff0e8ad651
 	github.com/last9/last9-cdk/go/tests v0.0.0-20211209093818-d351efae43f0
 	github.com/last9/pat v0.0.0-20211111093525-daacb495b5a9
 	github.com/lib/pq v1.10.4
@@ -14,6 +13,9 @@ require (
 	github.com/prometheus/client_model v0.2.0
 	github.com/shogo82148/go-sql-proxy v0.6.1
 	github.com/xo/dburl v0.9.0
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/sdk v1.24.0
+	go.opentelemetry.io/otel/trace v1.24.0
 	gopkg.in/go-playground/assert.v1 v1.2.1
 	gotest.tools v2.2.0+incompatible
 )
@@ -21,11 +23,14 @@ require (
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/go-logr/logr v1.4.1 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
 	github.com/golang/protobuf v1.4.3 // indirect
-	github.com/google/go-cmp v0.5.5 // indirect
+	github.com/google/go-cmp v0.6.0 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/prometheus/common v0.32.1 // indirect
 	github.com/prometheus/procfs v0.6.0 // indirect
-	golang.org/x/sys v0.1.0 // indirect
+	go.opentelemetry.io/otel/metric v1.24.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
 	google.golang.org/protobuf v1.26.0-rc.1 // indirect
 )
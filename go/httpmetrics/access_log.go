@@ -0,0 +1,82 @@
+package httpmetrics
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const defaultAccessLogMessage = "http request"
+
+// AccessLog emits a structured line per measured request, with exactly
+// the labels of http_requests_duration, so that the logs and the metrics
+// agree on what a route is, along with the duration, the bytes written
+// and the remote address.
+// How to use?
+// o := httpmetrics.Options{AccessLog: &httpmetrics.AccessLog{SampleRate: 0.1}}
+// m.Use(httpmetrics.REDHandlerWithOptions(o))
+type AccessLog struct {
+	// Logger defaults to slog.Default()
+	Logger *slog.Logger
+
+	// SampleRate is the ratio of successful requests that are logged, as
+	// for Rule.SampleRate: 1 logs them all, 0.1 10% and 0, the zero value,
+	// none. Failed requests, the 5xx ones, are always logged.
+	SampleRate float64
+
+	// Level of the successful requests, failed ones log at slog.LevelError.
+	// Defaults to slog.LevelInfo
+	Level slog.Level
+
+	// Message defaults to "http request"
+	Message string
+}
+
+// sampled reports whether a successful request is to be logged.
+func (a *AccessLog) sampled() bool {
+	return sampled(a.SampleRate)
+}
+
+// log writes the line of a request, if it is to be logged at all.
+func (a *AccessLog) log(
+	r *http.Request, labels map[string]string, d time.Duration, rw *ResponseWriter,
+) {
+	failed := isFailure(rw.code)
+	if !failed && !a.sampled() {
+		return
+	}
+
+	logger := a.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	level := a.Level
+	if failed {
+		level = slog.LevelError
+	}
+
+	ctx := r.Context()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+
+	msg := a.Message
+	if msg == "" {
+		msg = defaultAccessLogMessage
+	}
+
+	// in the order of defaultLabels, for the lines to read alike.
+	attrs := make([]slog.Attr, 0, len(defaultLabels)+3)
+	for _, l := range defaultLabels {
+		attrs = append(attrs, slog.String(l, labels[l]))
+	}
+
+	attrs = append(attrs,
+		slog.Duration("duration", d),
+		slog.Int("bytes", rw.Bytes()),
+		slog.String("remote_addr", r.RemoteAddr),
+	)
+
+	logger.LogAttrs(ctx, level, msg, attrs...)
+}
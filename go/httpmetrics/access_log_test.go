@@ -0,0 +1,89 @@
+package httpmetrics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	"github.com/last9/last9-cdk/go/tests"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestAccessLog(t *testing.T) {
+	resetMetrics()
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", basicHandler())
+	mux.Handle("/fail/", failingHandler())
+
+	o := Options{AccessLog: &AccessLog{Logger: logger}}
+	srv := tests.MakeServer(REDHandlerWithOptions(o)(mux))
+	defer srv.Close()
+
+	if _, err := tests.SendTestRequests(srv.URL, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(srv.URL + "/fail/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	// with the zero SampleRate, only the failure is logged.
+	var lines []map[string]interface{}
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var l map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &l); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, l)
+	}
+
+	assert.Equal(t, 1, len(lines))
+	l := lines[0]
+	assert.Equal(t, "ERROR", l["level"])
+	assert.Equal(t, "/fail/", l[labelPer])
+	assert.Equal(t, "500", l[labelStatus])
+	assert.Equal(t, "GET", l[labelMethod])
+	assert.Equal(t, true, l["remote_addr"] != "")
+	assert.Equal(t, true, l["duration"].(float64) > 0)
+	for _, k := range defaultLabels {
+		_, ok := l[k]
+		assert.Equal(t, true, ok)
+	}
+}
+
+func TestAccessLogBytes(t *testing.T) {
+	resetMetrics()
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", basicHandler())
+
+	o := Options{AccessLog: &AccessLog{Logger: logger, SampleRate: 1}}
+	srv := tests.MakeServer(REDHandlerWithOptions(o)(mux))
+	defer srv.Close()
+
+	if _, err := tests.SendTestRequests(srv.URL, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var l map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &l); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "INFO", l["level"])
+	assert.Equal(t, "200", l[labelStatus])
+	assert.Equal(t, float64(len("Ok")), l["bytes"])
+}
@@ -0,0 +1,248 @@
+package httpmetrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/last9/last9-cdk/go/proc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	zoneSatisfied  = "satisfied"
+	zoneTolerating = "tolerating"
+	zoneFrustrated = "frustrated"
+)
+
+// Apdex is the threshold that the users of a route are satisfied within.
+// Up to Tolerating they tolerate the wait, beyond that they are frustrated,
+// and so they are by a 5xx, however fast. The score is
+// (satisfied + tolerating/2) / total, from 0 to 1.
+type Apdex struct {
+	// Route is matched against the per label using path.Match, like
+	// "/api/*". Method, if set, has to match too. Empty matches all, which
+	// makes for a global threshold when it is the last one.
+	Route  string
+	Method string
+
+	// Satisfied is the threshold T, required. Tolerating defaults to 4T
+	Satisfied  time.Duration
+	Tolerating time.Duration
+
+	// Window of the score gauge. Defaults to, and is capped by,
+	// proc.DefaultRollingSpan.
+	Window time.Duration
+}
+
+func (a Apdex) withDefaults() Apdex {
+	if a.Tolerating < a.Satisfied {
+		a.Tolerating = 4 * a.Satisfied
+	}
+
+	if a.Window <= 0 {
+		a.Window = proc.DefaultRollingSpan
+	}
+
+	return a
+}
+
+// Validate reports what's wrong with the Apdex, if anything.
+func (a Apdex) Validate() error {
+	if a.Satisfied <= 0 {
+		return fmt.Errorf("apdex %v: satisfied threshold is not positive", a.Route)
+	}
+
+	return nil
+}
+
+func (a Apdex) key() string {
+	return fmt.Sprintf("%v %v %v %v", a.Method, a.Route, a.Satisfied, a.Tolerating)
+}
+
+// zone classifies a request.
+func (a Apdex) zone(d time.Duration, failed bool) string {
+	switch {
+	case failed || d > a.Tolerating:
+		return zoneFrustrated
+	case d > a.Satisfied:
+		return zoneTolerating
+	}
+
+	return zoneSatisfied
+}
+
+// apdexTracker keeps a rolling window per route of the requests that an
+// Apdex threshold applies to. The buckets are the two thresholds, so that
+// the counts are the satisfied, tolerating and frustrated ones.
+type apdexTracker struct {
+	apdex   Apdex
+	windows *proc.RollingSet
+}
+
+func newApdexTracker(a Apdex) *apdexTracker {
+	a = a.withDefaults()
+	return &apdexTracker{
+		apdex: a,
+		windows: proc.NewRollingSet(proc.RollingOptions{
+			Buckets: []float64{
+				proc.Milliseconds.Of(a.Satisfied),
+				proc.Milliseconds.Of(a.Tolerating),
+			},
+		}),
+	}
+}
+
+func (t *apdexTracker) record(labels map[string]string, d time.Duration, failed bool) {
+	zone := t.apdex.zone(d, failed)
+	l := prometheus.Labels{
+		labelPer:           labels[labelPer],
+		labelMethod:        labels[labelMethod],
+		proc.LabelProgram:  labels[proc.LabelProgram],
+		proc.LabelHostname: labels[proc.LabelHostname],
+	}
+
+	if zone == zoneFrustrated {
+		// a fast failure has to land beyond the tolerating bucket too.
+		d = t.apdex.Tolerating + time.Millisecond
+	}
+
+	t.windows.Observe(l, d, failed)
+
+	l["zone"] = zone
+	httpApdexRequests.With(l).Inc()
+}
+
+// score returns the Apdex of a window, given its counts per bucket.
+func score(counts []uint64) (float64, bool) {
+	var total uint64
+	for _, c := range counts {
+		total += c
+	}
+
+	if total == 0 || len(counts) != 3 {
+		return 0, false
+	}
+
+	return (float64(counts[0]) + float64(counts[1])/2) / float64(total), true
+}
+
+// apdexRegistry holds the thresholds that a middleware declared and
+// exposes the scores as gauges, computed at scrape time.
+type apdexRegistry struct {
+	mu       sync.Mutex
+	trackers map[string]*apdexTracker
+
+	score *prometheus.Desc
+}
+
+var (
+	apdexLabels = []string{
+		labelPer, labelMethod, proc.LabelProgram, proc.LabelHostname,
+	}
+
+	httpApdexRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_apdex_requests_total",
+			Help: "HTTP requests per Apdex zone: satisfied, tolerating, frustrated",
+		},
+		append([]string{"zone"}, apdexLabels...),
+	)
+
+	apdexes = &apdexRegistry{
+		trackers: map[string]*apdexTracker{},
+		score: prometheus.NewDesc(
+			"http_apdex_score",
+			"Apdex score per path over a sliding window",
+			apdexLabels, nil,
+		),
+	}
+)
+
+func init() {
+	prometheus.MustRegister(httpApdexRequests, apdexes)
+}
+
+// track returns the trackers of the thresholds, registering those not yet
+// seen. It panics on an invalid Apdex, as SLOs do.
+func (r *apdexRegistry) track(defs []Apdex) []*apdexTracker {
+	if len(defs) == 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]*apdexTracker, 0, len(defs))
+	for _, a := range defs {
+		if err := a.Validate(); err != nil {
+			panic(err)
+		}
+
+		a = a.withDefaults()
+		t, ok := r.trackers[a.key()]
+		if !ok {
+			t = newApdexTracker(a)
+			r.trackers[a.key()] = t
+		}
+
+		out = append(out, t)
+	}
+
+	return out
+}
+
+// recordApdex accounts the request against the first matching threshold.
+func recordApdex(
+	trackers []*apdexTracker, labels map[string]string, d time.Duration, failed bool,
+) {
+	for _, t := range trackers {
+		if matchRoute(t.apdex.Route, t.apdex.Method, labels) {
+			t.record(labels, d, failed)
+			return
+		}
+	}
+}
+
+// Describe implements prometheus.Collector
+func (r *apdexRegistry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.score
+}
+
+// Collect implements prometheus.Collector
+func (r *apdexRegistry) Collect(ch chan<- prometheus.Metric) {
+	r.mu.Lock()
+	trackers := make([]*apdexTracker, 0, len(r.trackers))
+	for _, t := range r.trackers {
+		trackers = append(trackers, t)
+	}
+	r.mu.Unlock()
+
+	// a route is scored once, even if two middlewares declared it.
+	seen := map[string]bool{}
+	for _, t := range trackers {
+		for _, s := range t.windows.Snapshot(t.apdex.Window) {
+			v, ok := score(s.Counts())
+			k := fmt.Sprint(s.Labels)
+			if !ok || seen[k] {
+				continue
+			}
+
+			seen[k] = true
+			ch <- prometheus.MustNewConstMetric(
+				r.score, prometheus.GaugeValue, v,
+				s.Labels[labelPer], s.Labels[labelMethod],
+				s.Labels[proc.LabelProgram], s.Labels[proc.LabelHostname],
+			)
+		}
+	}
+}
+
+// Reset forgets every threshold, along with its counters.
+func (r *apdexRegistry) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.trackers = map[string]*apdexTracker{}
+	httpApdexRequests.Reset()
+}
@@ -0,0 +1,61 @@
+package httpmetrics
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/last9/last9-cdk/go/proc"
+	"github.com/last9/last9-cdk/go/tests"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestApdex(t *testing.T) {
+	resetMetrics()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", basicHandler())
+	mux.Handle("/fail/", failingHandler())
+
+	o := Options{Apdex: []Apdex{{Satisfied: time.Minute}}}
+	srv := tests.MakeServer(REDHandlerWithOptions(o)(mux))
+	defer srv.Close()
+
+	if _, err := tests.SendTestRequests(srv.URL, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(srv.URL + "/fail/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	p, h := proc.GetProgamName(), proc.GetHostname()
+	assert.Equal(t, 3.0, testutil.ToFloat64(
+		httpApdexRequests.WithLabelValues(zoneSatisfied, "/api/", "GET", p, h),
+	))
+	assert.Equal(t, 1.0, testutil.ToFloat64(
+		httpApdexRequests.WithLabelValues(zoneFrustrated, "/fail/", "GET", p, h),
+	))
+
+	// one score per route, 1 for /api/ and 0 for /fail/
+	assert.Equal(t, 2, testutil.CollectAndCount(apdexes))
+}
+
+func TestApdexZones(t *testing.T) {
+	a := Apdex{Satisfied: 100 * time.Millisecond}.withDefaults()
+	assert.Equal(t, 400*time.Millisecond, a.Tolerating)
+	assert.Equal(t, zoneSatisfied, a.zone(100*time.Millisecond, false))
+	assert.Equal(t, zoneTolerating, a.zone(200*time.Millisecond, false))
+	assert.Equal(t, zoneFrustrated, a.zone(time.Second, false))
+	assert.Equal(t, zoneFrustrated, a.zone(time.Millisecond, true))
+
+	v, ok := score([]uint64{6, 2, 2})
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 0.7, v)
+
+	_, ok = score([]uint64{0, 0, 0})
+	assert.Equal(t, false, ok)
+}
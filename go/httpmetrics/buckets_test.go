@@ -0,0 +1,48 @@
+package httpmetrics
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/last9/last9-cdk/go/proc"
+	"github.com/last9/last9-cdk/go/tests"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestSetBuckets(t *testing.T) {
+	t.Run("invalid layouts are rejected", func(t *testing.T) {
+		assert.NotEqual(t, nil, SetBuckets(nil))
+		assert.NotEqual(t, nil, SetBuckets([]float64{5, 1}))
+	})
+
+	t.Run("preset layout is used by the histogram", func(t *testing.T) {
+		b, err := proc.PresetBuckets(proc.PresetFastAPI)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := SetBuckets(b); err != nil {
+			t.Fatal(err)
+		}
+		defer SetBuckets(proc.LatencyBins)
+
+		mux := http.NewServeMux()
+		mux.Handle("/api/", basicHandler())
+		srv := tests.MakeServer(REDHandler(bindMetrics(mux)))
+		defer srv.Close()
+
+		if _, err := tests.SendTestRequests(srv.URL, 2); err != nil {
+			t.Fatal(err)
+		}
+
+		o, err := tests.GetMetrics(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := o["http_requests_duration_milliseconds"].GetMetric()[0].GetHistogram()
+		// the exposition format adds a +Inf bucket of its own.
+		assert.Equal(t, len(b)+1, len(h.GetBucket()))
+		assert.Equal(t, b[len(b)-1], h.GetBucket()[len(b)-1].GetUpperBound())
+	})
+}
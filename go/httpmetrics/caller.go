@@ -0,0 +1,94 @@
+package httpmetrics
+
+import (
+	"net/http"
+
+	"github.com/last9/last9-cdk/go/proc"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	labelCaller = "caller"
+
+	// DefaultCallerHeader carries the name of the calling service.
+	DefaultCallerHeader = "X-Last9-Caller"
+
+	// callerOther is the caller label of a service that is not allowed.
+	callerOther = "other"
+)
+
+// CallerTransport stamps the name of this service on every outbound
+// request, for the called service's REDHandler to label its metrics with,
+// so that a service dependency graph can be built from metrics alone. It
+// injects the trace context of the request too, for the called service's
+// span to be a child of the caller's.
+// How to use?
+// client := &http.Client{Transport: httpmetrics.NewCallerTransport(nil)}
+type CallerTransport struct {
+	// Base does the actual round trip. Defaults to http.DefaultTransport
+	Base http.RoundTripper
+
+	// Header defaults to DefaultCallerHeader and Caller to
+	// proc.GetProgamName()
+	Header string
+	Caller string
+
+	// Propagator defaults to the W3C trace context.
+	Propagator propagation.TextMapPropagator
+}
+
+// NewCallerTransport wraps base with the defaults.
+func NewCallerTransport(base http.RoundTripper) *CallerTransport {
+	return &CallerTransport{Base: base}
+}
+
+// RoundTrip implements http.RoundTripper. The request is cloned, as a
+// RoundTripper must not modify it. A caller that's already set is left be.
+func (t *CallerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	header := t.Header
+	if header == "" {
+		header = DefaultCallerHeader
+	}
+
+	r = r.Clone(r.Context())
+	if r.Header.Get(header) == "" {
+		caller := t.Caller
+		if caller == "" {
+			caller = proc.GetProgamName()
+		}
+
+		r.Header.Set(header, caller)
+	}
+
+	p := propagatorOr(t.Propagator)
+	p.Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+	return base.RoundTrip(r)
+}
+
+// callerLabel reads the caller of an inbound request. An absent header is
+// an empty caller and one that's not allowed is "other", to bound the
+// cardinality that any client could otherwise blow up.
+func (o Options) callerLabel(r *http.Request) string {
+	header := o.CallerHeader
+	if header == "" {
+		header = DefaultCallerHeader
+	}
+
+	caller := r.Header.Get(header)
+	if caller == "" {
+		return ""
+	}
+
+	for _, c := range o.Callers {
+		if c == caller {
+			return caller
+		}
+	}
+
+	return callerOther
+}
@@ -0,0 +1,73 @@
+package httpmetrics
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/last9/last9-cdk/go/tests"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestCaller(t *testing.T) {
+	resetMetrics()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", basicHandler())
+	o := Options{Callers: []string{"checkout"}}
+	srv := tests.MakeServer(REDHandlerWithOptions(o)(bindMetrics(mux)))
+	defer srv.Close()
+
+	clients := []*http.Client{
+		{Transport: &CallerTransport{Caller: "checkout"}},
+		{Transport: &CallerTransport{Caller: "rogue"}},
+		{Transport: NewCallerTransport(nil)},
+		http.DefaultClient,
+	}
+
+	for _, c := range clients {
+		res, err := c.Get(srv.URL + "/api/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	metrics, err := tests.GetMetrics(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callers := map[string]uint64{}
+	for _, m := range metrics["http_requests_duration_milliseconds"].GetMetric() {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == labelCaller {
+				callers[l.GetValue()] += m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+
+	// the program name of the test binary is not allowed either.
+	assert.Equal(t, uint64(1), callers["checkout"])
+	assert.Equal(t, uint64(2), callers[callerOther])
+	assert.Equal(t, uint64(1), callers[""])
+}
+
+func TestCallerTransportKeepsHeader(t *testing.T) {
+	var got string
+	srv := tests.MakeServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(DefaultCallerHeader)
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set(DefaultCallerHeader, "gateway")
+
+	c := &http.Client{Transport: NewCallerTransport(nil)}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	assert.Equal(t, "gateway", got)
+}
@@ -21,6 +21,17 @@ import (
 type LabelMaker func(r *http.Request, mux http.Handler) map[string]string
 
 func figureOutLabelMaker(r *http.Request, m http.Handler) map[string]string {
+	perPath := routePattern(r, m)
+	if len(perPath) == 0 {
+		perPath = path.Clean(r.URL.Path)
+	}
+
+	return map[string]string{labelPer: perPath}
+}
+
+// routePattern returns the pattern that the mux routed the request by, if
+// the mux is one that we know of, empty otherwise.
+func routePattern(r *http.Request, m http.Handler) string {
 	var perPath string
 
 	switch t := m.(type) {
@@ -36,7 +47,10 @@ func figureOutLabelMaker(r *http.Request, m http.Handler) map[string]string {
 			}
 		}
 	case *chi.Mux:
-		perPath = chi.RouteContext(r.Context()).RoutePattern()
+		// the route context is chi's own, outside of the mux there is none.
+		if rc := chi.RouteContext(r.Context()); rc != nil {
+			perPath = rc.RoutePattern()
+		}
 	default:
 		// pat
 		if rk := r.Context().Value(pat.RouteKey); rk != nil {
@@ -55,9 +69,5 @@ func figureOutLabelMaker(r *http.Request, m http.Handler) map[string]string {
 		}
 	}
 
-	if len(perPath) == 0 {
-		perPath = path.Clean(r.URL.Path)
-	}
-
-	return map[string]string{labelPer: perPath}
+	return perPath
 }
@@ -0,0 +1,177 @@
+package httpmetrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/last9/last9-cdk/go/proc"
+)
+
+var measurementKey = last9Ctx("measurement")
+
+// measurement is what CustomREDHandler is in the middle of recording. It
+// rides on the request context so that whatever runs underneath, like the
+// LoadShedder, an inner REDHandler or the handler itself, can have a say
+// in what gets recorded.
+type measurement struct {
+	mu     sync.Mutex
+	status string            // overrides the status code, when set.
+	labels map[string]string // set by the handler, override the rest.
+	extra  []string          // the Options.Labels a handler may set too.
+
+	// inner are the labels of the custom LabelMakers of inner wrappers and
+	// route the pattern that an inner wrapper resolved. The innermost
+	// wrapper is the most specific, so the first to contribute wins.
+	inner map[string]string
+	route string
+}
+
+// handlerLabels are the labels that a handler may set. The rest are either
+// a property of the process, or of the request and response.
+var handlerLabels = []string{labelPer, proc.LabelTenant, proc.LabelCluster}
+
+// allows reports whether k may be recorded: one of the defaultLabels or
+// of the extra ones.
+func (m *measurement) allows(k string) bool {
+	if isDefaultLabel(k) {
+		return true
+	}
+
+	for _, l := range m.extra {
+		if l == k {
+			return true
+		}
+	}
+
+	return false
+}
+
+// settable returns the labels that a handler may set.
+func (m *measurement) settable() []string {
+	return append(append([]string(nil), handlerLabels...), m.extra...)
+}
+
+// withMeasurement returns a context that carries m.
+func withMeasurement(ctx context.Context, m *measurement) context.Context {
+	return context.WithValue(ctx, measurementKey, m)
+}
+
+// measurementFrom returns the measurement in progress, nil if none.
+func measurementFrom(ctx context.Context) *measurement {
+	m, _ := ctx.Value(measurementKey).(*measurement)
+	return m
+}
+
+func (m *measurement) setStatus(s string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status = s
+}
+
+func (m *measurement) getStatus() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+func (m *measurement) setLabel(k, v string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.labels == nil {
+		m.labels = map[string]string{}
+	}
+
+	m.labels[k] = v
+}
+
+// contribute adds the labels of an inner LabelMaker, unless a wrapper
+// further in already did.
+func (m *measurement) contribute(labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.inner == nil {
+		m.inner = map[string]string{}
+	}
+
+	for k, v := range labels {
+		if _, ok := m.inner[k]; !ok {
+			m.inner[k] = v
+		}
+	}
+}
+
+func (m *measurement) setRoute(p string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.route == "" {
+		m.route = p
+	}
+}
+
+func (m *measurement) getInner() (map[string]string, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[string]string, len(m.inner))
+	for k, v := range m.inner {
+		out[k] = v
+	}
+
+	return out, m.route
+}
+
+func (m *measurement) getLabels() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[string]string, len(m.labels))
+	for k, v := range m.labels {
+		out[k] = v
+	}
+
+	return out
+}
+
+// SetLabel attaches a label to the request that REDHandler is measuring,
+// for the handlers that learn, say, the tenant or the plan only as they
+// go. Only per, tenant, cluster and the Labels of the Options may be set,
+// it is an error to set any other. They take precedence over whatever the
+// LabelMaker says.
+// How to use?
+// h := httpmetrics.REDHandlerWithOptions(httpmetrics.Options{Labels: []string{"plan"}})
+// err := httpmetrics.SetLabel(r.Context(), "plan", plan)
+func SetLabel(ctx context.Context, key, value string) error {
+	m := measurementFrom(ctx)
+	if m == nil {
+		return fmt.Errorf("label %v: request is not being measured", key)
+	}
+
+	for _, l := range m.settable() {
+		if l == key {
+			m.setLabel(key, value)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("label %v: not one of %v", key, m.settable())
+}
+
+// AddLabels is SetLabel for many labels. The allowed ones are set even if
+// some are not, the error names one of those that were not.
+// How to use?
+// err := httpmetrics.AddLabels(r, map[string]string{"tenant": t, "cluster": c})
+func AddLabels(r *http.Request, labels map[string]string) error {
+	var out error
+	for k, v := range labels {
+		if err := SetLabel(r.Context(), k, v); err != nil && out == nil {
+			out = err
+		}
+	}
+
+	return out
+}
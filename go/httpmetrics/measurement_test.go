@@ -0,0 +1,123 @@
+package httpmetrics
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/last9/last9-cdk/go/proc"
+	"github.com/last9/last9-cdk/go/tests"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func tenantHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = SetLabel(r.Context(), proc.LabelTenant, "acme")
+		_ = AddLabels(r, map[string]string{proc.LabelCluster: "east"})
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func TestSetLabel(t *testing.T) {
+	assertTenant := func(t *testing.T, srv http.Handler) {
+		s := tests.MakeServer(srv)
+		defer s.Close()
+
+		if _, err := tests.SendTestRequests(s.URL, 2); err != nil {
+			t.Fatal(err)
+		}
+
+		o, err := tests.GetMetrics(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ms := o["http_requests_duration_milliseconds"].GetMetric()
+		assert.Equal(t, true, len(ms) > 0)
+		for _, m := range ms {
+			got := map[string]string{}
+			for _, l := range m.GetLabel() {
+				got[l.GetName()] = l.GetValue()
+			}
+
+			assert.Equal(t, "acme", got[proc.LabelTenant])
+			assert.Equal(t, "acme", got[labelL6etenant])
+			assert.Equal(t, "east", got[proc.LabelCluster])
+		}
+	}
+
+	t.Run("handler labels", func(t *testing.T) {
+		resetMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/api/", tenantHandler())
+		assertTenant(t, REDHandler(bindMetrics(mux)))
+	})
+
+	t.Run("nested wrapping", func(t *testing.T) {
+		resetMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/api/", REDHandler(tenantHandler()))
+		assertTenant(t, REDHandler(bindMetrics(mux)))
+	})
+
+	t.Run("extra labels", func(t *testing.T) {
+		resetMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/api/", http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				_ = SetLabel(r.Context(), "plan", "gold")
+				w.WriteHeader(http.StatusOK)
+			},
+		))
+
+		s := tests.MakeServer(REDHandlerWithOptions(Options{
+			Labels: []string{"plan"},
+		})(bindMetrics(mux)))
+		defer s.Close()
+
+		if _, err := tests.SendTestRequests(s.URL, 2); err != nil {
+			t.Fatal(err)
+		}
+
+		o, err := tests.GetMetrics(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the plan is set on the API requests and empty on the rest.
+		plans := map[string]string{}
+		for _, m := range o["http_requests_duration_milliseconds"].GetMetric() {
+			got := map[string]string{}
+			for _, l := range m.GetLabel() {
+				got[l.GetName()] = l.GetValue()
+			}
+
+			plans[got[labelPer]] = got["plan"]
+		}
+
+		assert.Equal(t, "gold", plans["/api/"])
+		assert.Equal(t, "", plans["/metrics"])
+	})
+}
+
+func TestSetLabelErrors(t *testing.T) {
+	assert.NotEqual(t, nil, SetLabel(context.Background(), proc.LabelTenant, "x"))
+
+	ctx := withMeasurement(context.Background(), &measurement{})
+	assert.Equal(t, nil, SetLabel(ctx, proc.LabelTenant, "x"))
+	assert.NotEqual(t, nil, SetLabel(ctx, labelStatus, "200"))
+	assert.NotEqual(t, nil, SetLabel(ctx, "plan", "gold"))
+
+	ctx = withMeasurement(context.Background(), &measurement{extra: []string{"plan"}})
+	assert.Equal(t, nil, SetLabel(ctx, "plan", "gold"))
+	assert.NotEqual(t, nil, SetLabel(ctx, "region", "eu"))
+}
+
+func TestRegisterLabels(t *testing.T) {
+	for _, bad := range []string{labelStatus, "1plan", "api-version", "__plan"} {
+		func() {
+			defer func() { assert.NotEqual(t, nil, recover()) }()
+			registerLabels([]string{bad})
+		}()
+	}
+}
@@ -1,7 +1,6 @@
 package httpmetrics
 
 import (
-	"context"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -12,6 +11,8 @@ import (
 	"github.com/last9/last9-cdk/go/proc"
 	"github.com/last9/pat"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -27,7 +28,7 @@ var (
 	defaultLabels = []string{
 		labelPer, proc.LabelHostname, labelDomain, labelMethod,
 		proc.LabelProgram, labelStatus, proc.LabelTenant, proc.LabelCluster,
-		labelL6etenant,
+		labelL6etenant, labelCaller,
 	}
 
 	// the ONLY metric that we emit is httpRequestsDuration
@@ -35,16 +36,15 @@ var (
 	// - Rate (every histogram has a _sum and _count!!)
 	// - Errors (by observing the status)
 	// - Duration (It's a histogram!!)
-	httpRequestsDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "http_requests_duration_milliseconds",
-			Help:    "HTTP requests duration per path",
-			Buckets: proc.LatencyBins,
+	// It is emitted as http_requests_duration_milliseconds and/or
+	// http_requests_duration_seconds, read SetDurationUnits.
+	httpRequestsDuration = proc.NewDurationHistogram(
+		proc.DurationHistogramOpts{
+			Name: "http_requests_duration",
+			Help: "HTTP requests duration per path",
 		},
 		defaultLabels,
 	)
-
-	enableMiddleware = last9Ctx("enabled")
 )
 
 func init() {
@@ -54,22 +54,79 @@ func init() {
 
 type last9Ctx string
 
-// middlewarePreEnabled looks for context key to rule out if the middleware
-// was pre-applied.
-//
-// When could this happen?
-// Imagine a scenario where a handler was wrapped as a middleware
-// as 		m.Get("/api/:id", REDHandler(patHandler()))
-// and subsequently, the whole mux was ALSO wrapped
-// as 		m.Use(REDHandler)
-// Only of the two middlewares is worth executing.
-func middlewarePreEnabled(r *http.Request) bool {
-	rv := r.Context().Value(middlewarePreEnabled)
-	if rv != nil && rv.(string) == "true" {
-		return true
+// SetDurationUnits chooses the unit(s) that request durations are recorded
+// in. Milliseconds is the default, for compatibility. Seconds follows the
+// Prometheus conventions and passing both emits both metrics, so that
+// dashboards can migrate before the milliseconds one is switched off.
+// How to use?
+// httpmetrics.SetDurationUnits(proc.Milliseconds, proc.Seconds)
+func SetDurationUnits(units ...proc.DurationUnit) {
+	httpRequestsDuration.SetUnits(units...)
+}
+
+// SetBuckets picks the bucket layout, in milliseconds, for the request
+// duration histogram, independent of the one sqlmetrics uses. Call it
+// before serving traffic as it drops whatever was recorded so far. The
+// layout is shared by every middleware of the process, as they all emit
+// in to the one histogram.
+// How to use?
+// b, _ := proc.PresetBuckets(proc.PresetFastAPI)
+// err := httpmetrics.SetBuckets(b)
+func SetBuckets(ms []float64) error {
+	return httpRequestsDuration.SetBuckets(ms)
+}
+
+// baseLabels are the labels that are known before the handler runs.
+func baseLabels(r *http.Request) prometheus.Labels {
+	return prometheus.Labels{
+		proc.LabelProgram:  proc.GetProgamName(),
+		proc.LabelHostname: proc.GetHostname(),
+		proc.LabelTenant:   "", // default tenant is empty
+		proc.LabelCluster:  "", // default cluster is empty
+		labelDomain:        r.Host,
+		labelMethod:        r.Method,
+		labelL6etenant:     "", // default l6etenant is empty
+		labelCaller:        "", // default caller is unknown
 	}
+}
 
-	return false
+// Options configure the RED middleware, once, for everything it wraps.
+type Options struct {
+	// LabelMaker defaults to the one that figures out the path pattern.
+	LabelMaker LabelMaker
+
+	// Rules are evaluated in order, before the LabelMaker runs, and the
+	// first one that matches decides. Requests that match none are
+	// measured as usual. Read InfraRules for a start.
+	Rules []Rule
+
+	// SLOs that the measured requests are accounted against, read SLO.
+	SLOs []SLO
+
+	// Apdex thresholds, the first one that matches a route applies.
+	Apdex []Apdex
+
+	// CallerHeader names the calling service, read CallerTransport for the
+	// outbound side. Defaults to DefaultCallerHeader. Only the Callers are
+	// recorded as such in the caller label, the rest are "other".
+	CallerHeader string
+	Callers      []string
+
+	// Labels are the labels, beyond per, tenant and cluster, that handlers
+	// may set with SetLabel, like plan or api_version. They are added to
+	// the request duration histogram, empty unless set. It is the one
+	// histogram for every middleware of the process, so they all get the
+	// labels and declaring one that is new drops what was recorded so far.
+	Labels []string
+
+	// AccessLog, if set, logs the measured requests.
+	AccessLog *AccessLog
+
+	// TracerProvider starts a server span per measured request. Defaults
+	// to the global one, otel.GetTracerProvider(). Propagator extracts the
+	// caller's trace context and defaults to the W3C one.
+	TracerProvider trace.TracerProvider
+	Propagator     propagation.TextMapPropagator
 }
 
 // CustomREDHandler is a 3rd way to wrap a handler with a custom labelMaker
@@ -82,6 +139,23 @@ func middlewarePreEnabled(r *http.Request) bool {
 // How to use?
 // mux.Handle("/api/", CustomREDHandler(labelMaker, basicHandler()))
 func CustomREDHandler(g LabelMaker, next http.Handler) http.Handler {
+	return CustomREDHandlerWithOptions(Options{LabelMaker: g}, next)
+}
+
+// CustomREDHandlerWithOptions is CustomREDHandler with Options.
+// How to use?
+// mux.Handle("/", CustomREDHandlerWithOptions(Options{Rules: rules}, h))
+func CustomREDHandlerWithOptions(o Options, next http.Handler) http.Handler {
+	g := o.LabelMaker
+	if g == nil {
+		g = figureOutLabelMaker
+	}
+
+	registerLabels(o.Labels)
+	tracer, propagator := o.tracer(), propagatorOr(o.Propagator)
+	trackers := slos.track(o.SLOs)
+	apdex := apdexes.track(o.Apdex)
+
 	// the custom label maker (g) might not return all the labels that our
 	// default label maker (figureOutLabelMaker) does, to handle this, we need
 	// to call the default but only if g itself is not the default.
@@ -91,29 +165,38 @@ func CustomREDHandler(g LabelMaker, next http.Handler) http.Handler {
 		fmt.Sprintf("%v", LabelMaker(figureOutLabelMaker))
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An outer wrapper is measuring already, read nested.
+		if m := measurementFrom(r.Context()); m != nil {
+			next.ServeHTTP(w, r)
+			nested(m, r, next, g, isCustomLabelMaker)
+			return
+		}
+
+		// Whatever the rules decide, a wrapper further in must not measure
+		// the request, so it gets a measurement that is thrown away.
+		m := &measurement{extra: o.Labels}
+		r = r.WithContext(withMeasurement(r.Context(), m))
+
+		rule := matchRule(o.Rules, r)
+		if rule.skips() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		rw := NewResponseWriter(w)
 		defer FinishResponseWriter(rw)
 
-		// If the middleware was already executed, skip this.
-		// read the function definition for scenarios where this is applicable.
-		if middlewarePreEnabled(r) {
+		if rule.isInfra() {
+			defer countInfra(rule, r, rw)
 			next.ServeHTTP(rw, r)
 			return
 		}
 
 		start := time.Now()
-		labels := prometheus.Labels{
-			proc.LabelProgram:  proc.GetProgamName(),
-			proc.LabelHostname: proc.GetHostname(),
-			proc.LabelTenant:   "", // default tenant is empty
-			proc.LabelCluster:  "", // default cluster is empty
-			labelDomain:        r.Host,
-			labelMethod:        r.Method,
-			labelL6etenant:     "", // default l6etenant is empty
-		}
+		labels := baseLabels(r)
+		labels[labelCaller] = o.callerLabel(r)
 
-		ctx := context.WithValue(r.Context(), enableMiddleware, "true")
-		r = r.WithContext(ctx)
+		r, span := startSpan(tracer, propagator, r)
 
 		defer func() {
 			// Status code and path can only be known AFTER the mux was invoked.
@@ -126,16 +209,31 @@ func CustomREDHandler(g LabelMaker, next http.Handler) http.Handler {
 				// its an expected labelKey. An attempt to set something else
 				// results in prometheus client library panic, and that would
 				// yield NO metrics.
-				for _, l := range defaultLabels {
-					if k == l {
+				if m.allows(k) {
+					labels[k] = v
+				}
+			}
+
+			// what the wrappers further in learnt is more specific, and the
+			// handler knows best, its labels override the rest.
+			inner, route := m.getInner()
+			if _, ok := labels[labelPer]; route != "" && (!ok || !isCustomLabelMaker) {
+				labels[labelPer] = route
+			}
+
+			for _, l := range []map[string]string{inner, m.getLabels()} {
+				for k, v := range l {
+					if m.allows(k) {
 						labels[k] = v
-						break
 					}
 				}
 			}
 
 			// Status code can only be known AFTER the mux was invoked.
 			labels[labelStatus] = strconv.Itoa(rw.code)
+			if s := m.getStatus(); s != "" {
+				labels[labelStatus] = s
+			}
 
 			if isCustomLabelMaker {
 				for k, v := range figureOutLabelMaker(r, next) {
@@ -147,9 +245,19 @@ func CustomREDHandler(g LabelMaker, next http.Handler) http.Handler {
 
 			labels[labelL6etenant] = labels[proc.LabelTenant]
 
-			httpRequestsDuration.With(labels).Observe(
-				float64(time.Since(start).Milliseconds()),
-			)
+			d := time.Since(start)
+			httpRequestsDuration.Observe(labels, d)
+			observeWindow(labels, d, isFailure(rw.code))
+			for _, t := range trackers {
+				t.record(labels, d, isFailure(rw.code))
+			}
+
+			recordApdex(apdex, labels, d, isFailure(rw.code))
+			if o.AccessLog != nil {
+				o.AccessLog.log(r, labels, d, rw)
+			}
+
+			endSpan(span, labels, rw.code)
 		}()
 
 		//call the wrapped handler
@@ -158,25 +266,90 @@ func CustomREDHandler(g LabelMaker, next http.Handler) http.Handler {
 	})
 }
 
+// nested is what a wrapper does when an outer one is already measuring.
+//
+// When could this happen?
+// Imagine a scenario where a handler was wrapped as a middleware
+// as 		m.Get("/api/:id", REDHandler(patHandler()))
+// and subsequently, the whole mux was ALSO wrapped
+// as 		m.Use(REDHandler)
+// The outermost wrapper measures, once. The inner ones contribute the
+// labels of their custom LabelMaker or, with the default LabelMaker, the
+// route pattern if they can resolve it, as they are closer to the router.
+// Precedence, highest first: labels set by the handler, inner custom
+// LabelMakers, the outer custom LabelMaker, inner route patterns, the
+// outer default LabelMaker. The Options of the outermost wrapper apply.
+func nested(
+	m *measurement, r *http.Request, next http.Handler, g LabelMaker, custom bool,
+) {
+	if custom {
+		m.contribute(g(r, next))
+		return
+	}
+
+	if p := routePattern(r, next); p != "" {
+		m.setRoute(p)
+	}
+}
+
+// isDefaultLabel reports whether k is one of the defaultLabels. An attempt
+// to set something else results in prometheus client library panic.
+func isDefaultLabel(k string) bool {
+	for _, l := range defaultLabels {
+		if k == l {
+			return true
+		}
+	}
+
+	return false
+}
+
+// registerLabels adds the extra labels of Options to the request duration
+// histogram. It panics on a name that is invalid or already a label, as
+// the SLOs do on an invalid SLO.
+func registerLabels(names []string) {
+	for _, n := range names {
+		if isDefaultLabel(n) {
+			panic(fmt.Errorf("label %v: is already a label", n))
+		}
+	}
+
+	if err := httpRequestsDuration.AddLabels(names...); err != nil {
+		panic(err)
+	}
+}
+
 // REDHandlerWithLabelMaker is the 2nd choice of wrapping the entire Mux
 // with a middleware. Passing the middleware to a mux is a fairly common
 // technique with the likes of gorilla etc.
 // How to Use?
 // m.Use(REDHandlerWithLabelMaker(labelMaker))
 func REDHandlerWithLabelMaker(g LabelMaker) func(http.Handler) http.Handler {
+	return REDHandlerWithOptions(Options{LabelMaker: g})
+}
+
+// REDHandlerWithOptions is REDHandlerWithLabelMaker with Options.
+// How to Use?
+// m.Use(REDHandlerWithOptions(Options{Rules: httpmetrics.InfraRules()}))
+func REDHandlerWithOptions(o Options) func(http.Handler) http.Handler {
+	// declare the labels, SLOs and Apdex up front, for their series to show
+	// before traffic.
+	registerLabels(o.Labels)
+	slos.track(o.SLOs)
+	apdexes.track(o.Apdex)
 	return func(next http.Handler) http.Handler {
 		switch t := next.(type) {
 		case *mux.Router:
-			t.Use(REDHandlerWithLabelMaker(g))
+			t.Use(REDHandlerWithOptions(o))
 			return t
 		case *pat.PatternServeMux:
-			t.Use(REDHandlerWithLabelMaker(g))
+			t.Use(REDHandlerWithOptions(o))
 			return t
 		case *chi.Mux:
 			// go-chi: all middlewares must be defined before routes on a mux
 			return t
 		}
-		return CustomREDHandler(g, next)
+		return CustomREDHandlerWithOptions(o, next)
 	}
 }
 
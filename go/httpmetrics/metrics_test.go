@@ -12,7 +12,7 @@ import (
 )
 
 func resetMetrics() {
-	tests.ResetMetrics(httpRequestsDuration)
+	tests.ResetMetrics(httpRequestsDuration, requestWindows, httpInfraRequests, slos, apdexes)
 }
 
 func getDomain(s *httptest.Server) string {
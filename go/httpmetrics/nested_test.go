@@ -0,0 +1,146 @@
+package httpmetrics
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/mux"
+	"github.com/last9/last9-cdk/go/proc"
+	"github.com/last9/last9-cdk/go/tests"
+	"github.com/last9/pat"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+// tenantMaker is an inner custom LabelMaker.
+func tenantMaker(r *http.Request, _ http.Handler) map[string]string {
+	return map[string]string{proc.LabelTenant: "inner"}
+}
+
+// assertOnce asserts that every request was recorded exactly once, under
+// a single series with the expected per and tenant.
+func assertOnce(t *testing.T, srv http.Handler, per, tenant string) {
+	t.Helper()
+	resetMetrics()
+
+	s := tests.MakeServer(srv)
+	defer s.Close()
+
+	if _, err := tests.SendTestRequests(s.URL, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := tests.GetMetrics(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms := o["http_requests_duration_milliseconds"].GetMetric()
+	assert.Equal(t, 1, len(ms))
+	assert.Equal(t, uint64(4), ms[0].GetHistogram().GetSampleCount())
+
+	got := map[string]string{}
+	for _, l := range ms[0].GetLabel() {
+		got[l.GetName()] = l.GetValue()
+	}
+
+	assert.Equal(t, per, got[labelPer])
+	assert.Equal(t, tenant, got[proc.LabelTenant])
+}
+
+func TestNestedServeMux(t *testing.T) {
+	t.Run("mux and handler", func(t *testing.T) {
+		m := http.NewServeMux()
+		m.Handle("/api/", REDHandler(basicHandler()))
+		assertOnce(t, REDHandler(bindMetrics(m)), "/api/", "")
+	})
+
+	t.Run("inner custom label maker contributes", func(t *testing.T) {
+		m := http.NewServeMux()
+		m.Handle("/api/", CustomREDHandler(tenantMaker, basicHandler()))
+		assertOnce(t, REDHandler(bindMetrics(m)), "/api/", "inner")
+	})
+
+	t.Run("handler labels win", func(t *testing.T) {
+		m := http.NewServeMux()
+		m.Handle("/api/", CustomREDHandler(tenantMaker, tenantHandler()))
+		assertOnce(t, REDHandler(bindMetrics(m)), "/api/", "acme")
+	})
+}
+
+func TestNestedGorilla(t *testing.T) {
+	t.Run("mux and handler", func(t *testing.T) {
+		m := mux.NewRouter()
+		m.Handle("/api/{id}", REDHandler(gorillaHandler()))
+		m.Handle("/metrics", promhttp.Handler())
+		assertOnce(t, REDHandler(m), "/api/{id}", "")
+	})
+
+	t.Run("inner custom label maker contributes", func(t *testing.T) {
+		m := mux.NewRouter()
+		m.Handle("/api/{id}", CustomREDHandler(tenantMaker, gorillaHandler()))
+		m.Handle("/metrics", promhttp.Handler())
+		m.Use(REDHandler)
+		assertOnce(t, m, "/api/{id}", "inner")
+	})
+}
+
+func TestNestedPat(t *testing.T) {
+	t.Run("mux and handler", func(t *testing.T) {
+		m := pat.New()
+		m.Get("/api/:id", REDHandler(patHandler()))
+		m.Get("/metrics", promhttp.Handler())
+		m.Use(REDHandler)
+		assertOnce(t, REDHandler(m), "/api/:id", "")
+	})
+
+	t.Run("inner custom label maker contributes", func(t *testing.T) {
+		m := pat.New()
+		m.Get("/api/:id", CustomREDHandler(tenantMaker, patHandler()))
+		m.Get("/metrics", promhttp.Handler())
+		m.Use(REDHandler)
+		assertOnce(t, m, "/api/:id", "inner")
+	})
+}
+
+func TestNestedChi(t *testing.T) {
+	t.Run("mux and handler", func(t *testing.T) {
+		m := chi.NewRouter()
+		m.Use(REDHandler)
+		m.Handle("/api/{id}", REDHandler(gochiHandler()))
+		m.Handle("/metrics", promhttp.Handler())
+		assertOnce(t, m, "/api/{id}", "")
+	})
+
+	t.Run("inner custom label maker contributes", func(t *testing.T) {
+		m := chi.NewRouter()
+		m.Use(REDHandler)
+		m.Handle("/api/{id}", CustomREDHandler(tenantMaker, gochiHandler()))
+		m.Handle("/metrics", promhttp.Handler())
+		assertOnce(t, m, "/api/{id}", "inner")
+	})
+
+	t.Run("outer plain wrapper learns the route", func(t *testing.T) {
+		m := chi.NewRouter()
+		m.Handle("/api/{id}", REDHandler(gochiHandler()))
+		m.Handle("/metrics", promhttp.Handler())
+		assertOnce(t, CustomREDHandler(nil, m), "/api/{id}", "")
+	})
+}
+
+func TestNestedRulesExclude(t *testing.T) {
+	resetMetrics()
+
+	m := http.NewServeMux()
+	m.Handle("/api/", REDHandler(basicHandler()))
+	o := Options{Rules: []Rule{{PathPrefix: "/api/", Action: Exclude}}}
+	s := tests.MakeServer(REDHandlerWithOptions(o)(m))
+	defer s.Close()
+
+	if _, err := tests.SendTestRequests(s.URL, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 0, len(Snapshot(0)))
+}
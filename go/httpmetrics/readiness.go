@@ -0,0 +1,239 @@
+package httpmetrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/last9/last9-cdk/go/proc"
+)
+
+const (
+	defaultReadinessWindow = time.Minute
+	defaultMinRequests     = 20
+	defaultRecoverFactor   = 0.8
+)
+
+// ReadinessRule fails readiness when the traffic of matching routes, as
+// seen by REDHandler, degrades beyond a threshold.
+type ReadinessRule struct {
+	// Name identifies the rule in the JSON response. Defaults to Route.
+	Name string
+
+	// Route is matched against the per label using path.Match, like
+	// "/api/*". Method, if set, has to match too. Empty matches all.
+	Route  string
+	Method string
+
+	// Window over which the traffic is judged. Defaults to 1m and is
+	// capped by proc.DefaultRollingSpan.
+	Window time.Duration
+
+	// MaxErrorRatio of 5xx responses, 0.05 being 5%. Zero disables it.
+	MaxErrorRatio float64
+
+	// MaxP99 latency. Zero disables it.
+	MaxP99 time.Duration
+
+	// MinRequests below which the rule does not judge, as a handful of
+	// requests say little. Defaults to 20
+	MinRequests uint64
+}
+
+func (r ReadinessRule) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+
+	if r.Route != "" {
+		return r.Route
+	}
+
+	return "*"
+}
+
+func (r ReadinessRule) matches(labels map[string]string) bool {
+	return matchRoute(r.Route, r.Method, labels)
+}
+
+// matchRoute matches the per label using path.Match, and the method label.
+// Empty route and method match all.
+func matchRoute(route, method string, labels map[string]string) bool {
+	if method != "" && !strings.EqualFold(method, labels[labelMethod]) {
+		return false
+	}
+
+	if route == "" {
+		return true
+	}
+
+	ok, err := path.Match(route, labels[labelPer])
+	return err == nil && ok
+}
+
+// ReadinessOptions to be passed to NewReadiness.
+type ReadinessOptions struct {
+	Rules []ReadinessRule
+
+	// RecoverFactor is the hysteresis. A tripped rule recovers only once
+	// the traffic is back under threshold*RecoverFactor, so that a pod
+	// hovering around the threshold does not flap. Defaults to 0.8
+	RecoverFactor float64
+}
+
+// RuleStatus explains the verdict of a rule.
+type RuleStatus struct {
+	Name       string  `json:"name"`
+	Tripped    bool    `json:"tripped"`
+	Reason     string  `json:"reason,omitempty"`
+	Requests   uint64  `json:"requests"`
+	ErrorRatio float64 `json:"error_ratio"`
+	P99        float64 `json:"p99_milliseconds"`
+}
+
+// ReadinessStatus is the body that the readiness handler responds with.
+type ReadinessStatus struct {
+	Ready bool         `json:"ready"`
+	Rules []RuleStatus `json:"rules"`
+}
+
+// Readiness judges whether this process should receive traffic, from the
+// point of view of the traffic it already received. It is an http.Handler
+// for a readiness probe and its Check plugs in to proc.ServerOptions.Ready
+// How to use?
+// rd := httpmetrics.NewReadiness(httpmetrics.ReadinessOptions{Rules: rules})
+// mux.Handle("/readyz", rd)
+// or proc.ServerOptions{Ready: rd.Check}
+type Readiness struct {
+	opts ReadinessOptions
+
+	mu      sync.Mutex
+	tripped map[int]bool
+}
+
+// NewReadiness returns a Readiness that evaluates the rules on every probe.
+// It enables the snapshots that the rules are judged by.
+func NewReadiness(o ReadinessOptions) *Readiness {
+	EnableSnapshots()
+	if o.RecoverFactor <= 0 || o.RecoverFactor > 1 {
+		o.RecoverFactor = defaultRecoverFactor
+	}
+
+	return &Readiness{opts: o, tripped: map[int]bool{}}
+}
+
+// Evaluate runs every rule against the current snapshots.
+func (rd *Readiness) Evaluate() ReadinessStatus {
+	out := ReadinessStatus{Ready: true}
+	cache := map[time.Duration][]proc.LabeledSnapshot{}
+
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	for i, rule := range rd.opts.Rules {
+		window := rule.Window
+		if window <= 0 {
+			window = defaultReadinessWindow
+		}
+
+		snaps, ok := cache[window]
+		if !ok {
+			snaps = Snapshot(window)
+			cache[window] = snaps
+		}
+
+		var matched []proc.Snapshot
+		for _, s := range snaps {
+			if rule.matches(s.Labels) {
+				matched = append(matched, s.Snapshot)
+			}
+		}
+
+		st := rd.judge(i, rule, proc.MergeSnapshots(matched...))
+		if st.Tripped {
+			out.Ready = false
+		}
+
+		out.Rules = append(out.Rules, st)
+	}
+
+	return out
+}
+
+// judge applies the thresholds, or the relaxed ones if already tripped.
+func (rd *Readiness) judge(i int, rule ReadinessRule, s proc.Snapshot) RuleStatus {
+	st := RuleStatus{
+		Name:       rule.name(),
+		Requests:   s.Count,
+		ErrorRatio: s.ErrorRatio,
+		P99:        proc.Milliseconds.Of(s.P99),
+	}
+
+	minRequests := rule.MinRequests
+	if minRequests == 0 {
+		minRequests = defaultMinRequests
+	}
+
+	if s.Count < minRequests {
+		rd.tripped[i] = false
+		return st
+	}
+
+	factor := 1.0
+	if rd.tripped[i] {
+		factor = rd.opts.RecoverFactor
+	}
+
+	var reasons []string
+	if rule.MaxErrorRatio > 0 && s.ErrorRatio > rule.MaxErrorRatio*factor {
+		reasons = append(reasons, fmt.Sprintf(
+			"error ratio %.4f > %.4f", s.ErrorRatio, rule.MaxErrorRatio*factor,
+		))
+	}
+
+	maxP99 := time.Duration(float64(rule.MaxP99) * factor)
+	if rule.MaxP99 > 0 && s.P99 > maxP99 {
+		reasons = append(reasons, fmt.Sprintf("p99 %v > %v", s.P99, maxP99))
+	}
+
+	rd.tripped[i] = len(reasons) > 0
+	st.Tripped = rd.tripped[i]
+	st.Reason = strings.Join(reasons, ", ")
+	return st
+}
+
+// Check returns an error naming the tripped rules, if any.
+func (rd *Readiness) Check() error {
+	st := rd.Evaluate()
+	if st.Ready {
+		return nil
+	}
+
+	var reasons []string
+	for _, r := range st.Rules {
+		if r.Tripped {
+			reasons = append(reasons, r.Name+": "+r.Reason)
+		}
+	}
+
+	return fmt.Errorf("not ready: %v", strings.Join(reasons, "; "))
+}
+
+// ServeHTTP responds 200 when ready and 503 otherwise, with a JSON body
+// explaining every rule.
+func (rd *Readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := rd.Evaluate()
+
+	w.Header().Set("Content-Type", "application/json")
+	if st.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_ = json.NewEncoder(w).Encode(st)
+}
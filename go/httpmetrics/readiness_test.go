@@ -0,0 +1,78 @@
+package httpmetrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/last9/last9-cdk/go/proc"
+	"github.com/last9/last9-cdk/go/tests"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestReadiness(t *testing.T) {
+	t.Run("failing route trips readiness", func(t *testing.T) {
+		resetMetrics()
+
+		mux := http.NewServeMux()
+		mux.Handle("/api/", basicHandler())
+		mux.Handle("/fail/", failingHandler())
+		srv := tests.MakeServer(REDHandler(mux))
+		defer srv.Close()
+
+		if _, err := tests.SendTestRequests(srv.URL, 3); err != nil {
+			t.Fatal(err)
+		}
+
+		rd := NewReadiness(ReadinessOptions{Rules: []ReadinessRule{
+			{Route: "/api/*", MaxErrorRatio: 0.5, MinRequests: 2},
+			{Name: "failures", Route: "/fail/*", MaxErrorRatio: 0.5, MinRequests: 2},
+		}})
+
+		w := httptest.NewRecorder()
+		rd.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, nil, rd.Check())
+
+		for i := 0; i < 2; i++ {
+			res, err := http.Get(srv.URL + "/fail/x")
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+		}
+
+		w = httptest.NewRecorder()
+		rd.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.NotEqual(t, nil, rd.Check())
+
+		var st ReadinessStatus
+		if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, false, st.Ready)
+		assert.Equal(t, false, st.Rules[0].Tripped)
+		assert.Equal(t, "failures", st.Rules[1].Name)
+		assert.Equal(t, true, st.Rules[1].Tripped)
+		assert.Equal(t, uint64(2), st.Rules[1].Requests)
+	})
+
+	t.Run("tripped rule recovers with hysteresis", func(t *testing.T) {
+		rule := ReadinessRule{MaxErrorRatio: 0.1}
+		rd := NewReadiness(ReadinessOptions{Rules: []ReadinessRule{rule}})
+
+		judge := func(ratio float64) bool {
+			return rd.judge(0, rule, proc.Snapshot{
+				Count: 100, ErrorRatio: ratio,
+			}).Tripped
+		}
+
+		assert.Equal(t, false, judge(0.09))
+		assert.Equal(t, true, judge(0.11))
+		assert.Equal(t, true, judge(0.09))
+		assert.Equal(t, false, judge(0.07))
+	})
+}
@@ -10,9 +10,10 @@ import (
 // once previously set during the lifetime of a handler.
 // We rely on the status code to be emitted as one of the labels.
 type ResponseWriter struct {
-	w    http.ResponseWriter
-	resp []byte
-	code int
+	w     http.ResponseWriter
+	resp  []byte
+	code  int
+	bytes int
 }
 
 func (rw *ResponseWriter) Header() http.Header {
@@ -26,6 +27,11 @@ func (rw *ResponseWriter) Code() int {
 	return rw.code
 }
 
+// Bytes returns the number of bytes of the body written so far.
+func (rw *ResponseWriter) Bytes() int {
+	return rw.bytes
+}
+
 func (rw *ResponseWriter) WriteHeader(statusCode int) {
 	rw.code = statusCode
 	rw.w.WriteHeader(statusCode)
@@ -39,7 +45,9 @@ func (rw *ResponseWriter) Write(data []byte) (int, error) {
 		rw.code = http.StatusOK
 	}
 
-	return rw.w.Write(data)
+	n, err := rw.w.Write(data)
+	rw.bytes += n
+	return n, err
 }
 
 func (rw *ResponseWriter) CloseNotify() <-chan bool {
@@ -69,6 +77,7 @@ func FinishResponseWriter(rw *ResponseWriter) {
 
 	rw.w = nil
 	rw.code = 0
+	rw.bytes = 0
 	rw.resp = rw.resp[:0]
 	rwPool.Put(rw)
 }
@@ -0,0 +1,179 @@
+package httpmetrics
+
+import (
+	"math/rand"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/last9/last9-cdk/go/proc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RuleAction is what happens to a request that matches a Rule.
+type RuleAction int
+
+const (
+	// Exclude leaves the request out of every metric.
+	Exclude RuleAction = iota
+	// Infra counts the request in http_infra_requests_total instead, a
+	// low cardinality series that keeps probes and scrapes out of RED.
+	Infra
+	// Sample measures only a SampleRate fraction of the requests.
+	Sample
+)
+
+// Rule matches requests on their raw path, method and headers, before any
+// LabelMaker runs. A Rule with no criteria matches every request.
+type Rule struct {
+	// Name is the rule label of the Infra series. Defaults to "infra"
+	Name string
+
+	// Path is a path.Match pattern like "/debug/*" and PathPrefix a plain
+	// prefix like "/static/". Either, or both, may be set.
+	Path       string
+	PathPrefix string
+
+	// Methods, if any, of which one has to match.
+	Methods []string
+
+	// Headers that have to be present with the value, or with any value if
+	// the value is empty.
+	Headers map[string]string
+
+	Action RuleAction
+
+	// SampleRate is the ratio of requests that a Sample rule measures: 1
+	// measures them all, 0.1 10% and 0, the zero value, none.
+	SampleRate float64
+}
+
+func (rl *Rule) matches(r *http.Request) bool {
+	p := r.URL.Path
+	if rl.Path != "" {
+		if ok, err := path.Match(rl.Path, p); err != nil || !ok {
+			return false
+		}
+	}
+
+	if rl.PathPrefix != "" && !strings.HasPrefix(p, rl.PathPrefix) {
+		return false
+	}
+
+	if len(rl.Methods) > 0 {
+		var found bool
+		for _, m := range rl.Methods {
+			if strings.EqualFold(m, r.Method) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	for k, v := range rl.Headers {
+		got, ok := r.Header[http.CanonicalHeaderKey(k)]
+		if !ok || (v != "" && (len(got) == 0 || got[0] != v)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// skips reports whether the request is to be left alone altogether.
+func (rl *Rule) skips() bool {
+	if rl == nil {
+		return false
+	}
+
+	switch rl.Action {
+	case Exclude:
+		return true
+	case Sample:
+		return !sampled(rl.SampleRate)
+	}
+
+	return false
+}
+
+// sampled reports whether a request makes the cut of the rate: always at
+// 1 or more, never at 0 or less.
+func sampled(rate float64) bool {
+	switch {
+	case rate >= 1:
+		return true
+	case rate <= 0:
+		return false
+	}
+
+	return rand.Float64() < rate // #nosec G404 not for crypto.
+}
+
+func (rl *Rule) isInfra() bool {
+	return rl != nil && rl.Action == Infra
+}
+
+func (rl *Rule) name() string {
+	if rl.Name == "" {
+		return "infra"
+	}
+
+	return rl.Name
+}
+
+// matchRule returns the first rule that matches, nil if none does.
+func matchRule(rules []Rule, r *http.Request) *Rule {
+	for i := range rules {
+		if rules[i].matches(r) {
+			return &rules[i]
+		}
+	}
+
+	return nil
+}
+
+// InfraRules returns the rules that most services want: CORS preflights,
+// scrapes and probes are counted as Infra, out of the RED metrics.
+func InfraRules() []Rule {
+	return []Rule{
+		{Name: "preflight", Methods: []string{http.MethodOptions}, Action: Infra},
+		{Name: "metrics", Path: "/metrics", Action: Infra},
+		{Name: "health", Path: "/healthz", Action: Infra},
+		{Name: "health", Path: "/readyz", Action: Infra},
+		{Name: "health", Path: "/livez", Action: Infra},
+	}
+}
+
+var (
+	infraLabels = []string{
+		"rule", labelMethod, labelStatus, proc.LabelProgram, proc.LabelHostname,
+	}
+
+	httpInfraRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_infra_requests_total",
+			Help: "HTTP requests that matched an Infra rule",
+		},
+		infraLabels,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(httpInfraRequests)
+}
+
+// countInfra records a request that matched an Infra rule.
+func countInfra(rl *Rule, r *http.Request, rw *ResponseWriter) {
+	httpInfraRequests.With(prometheus.Labels{
+		"rule":             rl.name(),
+		labelMethod:        r.Method,
+		labelStatus:        strconv.Itoa(rw.code),
+		proc.LabelProgram:  proc.GetProgamName(),
+		proc.LabelHostname: proc.GetHostname(),
+	}).Inc()
+}
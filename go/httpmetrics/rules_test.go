@@ -0,0 +1,103 @@
+package httpmetrics
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/last9/last9-cdk/go/tests"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestRules(t *testing.T) {
+	resetMetrics()
+	EnableSnapshots()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", basicHandler())
+	mux.Handle("/healthz", basicHandler())
+	mux.Handle("/static/", basicHandler())
+
+	rules := append(InfraRules(),
+		Rule{PathPrefix: "/static/", Action: Exclude},
+		Rule{Headers: map[string]string{"X-Synthetic": ""}, Action: Exclude},
+		Rule{Path: "/api/*", Action: Sample, SampleRate: 0},
+	)
+
+	srv := tests.MakeServer(CustomREDHandlerWithOptions(Options{Rules: rules}, mux))
+	defer srv.Close()
+
+	get := func(p string, h map[string]string) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for k, v := range h {
+			req.Header.Set(k, v)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	get("/healthz", nil)
+	get("/healthz", nil)
+	get("/static/app.js", nil)
+	get("/api/1", nil)
+	get("/other", map[string]string{"X-Synthetic": "1"})
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(httpInfraRequests))
+	assert.Equal(t, 0, len(Snapshot(time.Minute)))
+
+	// No rule matches, so it is measured.
+	get("/other", nil)
+	assert.Equal(t, 1, len(Snapshot(time.Minute)))
+}
+
+func TestRuleMatches(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodOptions, "http://x/api/1", nil)
+	req.Header.Set("X-Env", "canary")
+
+	cases := []struct {
+		rule Rule
+		want bool
+	}{
+		{Rule{}, true},
+		{Rule{Path: "/api/*"}, true},
+		{Rule{Path: "/api"}, false},
+		{Rule{PathPrefix: "/api/"}, true},
+		{Rule{Methods: []string{"get", "options"}}, true},
+		{Rule{Methods: []string{http.MethodGet}}, false},
+		{Rule{Headers: map[string]string{"x-env": "canary"}}, true},
+		{Rule{Headers: map[string]string{"X-Env": "prod"}}, false},
+		{Rule{Headers: map[string]string{"X-Missing": ""}}, false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.want, c.rule.matches(req))
+	}
+
+	assert.Equal(t, "preflight", matchRule(InfraRules(), req).Name)
+}
+
+func TestSampled(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		// the zero value is none, for the AccessLog and the Rule alike.
+		assert.Equal(t, false, sampled(0))
+		assert.Equal(t, false, sampled(-1))
+		assert.Equal(t, true, sampled(1))
+	}
+
+	rl := Rule{Action: Sample}
+	assert.Equal(t, true, rl.skips())
+	assert.Equal(t, false, (&AccessLog{}).sampled())
+
+	rl.SampleRate = 1
+	assert.Equal(t, false, rl.skips())
+	assert.Equal(t, true, (&AccessLog{SampleRate: 1}).sampled())
+}
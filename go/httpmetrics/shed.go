@@ -0,0 +1,260 @@
+package httpmetrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statusShed is the status label of a request that was shed.
+const statusShed = "shed"
+
+const (
+	defaultInitialLimit = 20
+	defaultMinLimit     = 1
+	defaultMaxLimit     = 1000
+	defaultBackoff      = 0.9
+	defaultRetryAfter   = time.Second
+	defaultMaxShedKeys  = 100
+	overflowShedKey     = "other"
+)
+
+// ShedOptions configure a LoadShedder.
+type ShedOptions struct {
+	// TargetLatency is the latency that the handlers are expected to stay
+	// under. A slower response backs the limit off. A fast 5xx, likely bad
+	// input rather than overload, neither grows nor shrinks it. Required.
+	TargetLatency time.Duration
+
+	// InitialLimit, MinLimit and MaxLimit bound the number of concurrent
+	// requests. Default to 20, 1 and 1000
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+
+	// Backoff is the multiplicative decrease, 0.9 cuts the limit by 10%
+	Backoff float64
+
+	// RetryAfter is advertised to the shed clients. Defaults to 1s
+	RetryAfter time.Duration
+
+	// Key partitions the limit, nil means one global limit. RouteKey gives
+	// a limit per route. At most MaxKeys partitions are tracked, the rest
+	// share an "other" limit. MaxKeys defaults to 100
+	Key     func(r *http.Request) string
+	MaxKeys int
+}
+
+// Validate reports the options that have no sensible default.
+func (o ShedOptions) Validate() error {
+	if o.TargetLatency <= 0 {
+		return fmt.Errorf("shed: target latency %v is not positive", o.TargetLatency)
+	}
+
+	return nil
+}
+
+func (o ShedOptions) withDefaults() ShedOptions {
+	if o.MinLimit <= 0 {
+		o.MinLimit = defaultMinLimit
+	}
+
+	if o.MaxLimit <= 0 {
+		o.MaxLimit = defaultMaxLimit
+	}
+
+	if o.InitialLimit <= 0 {
+		o.InitialLimit = defaultInitialLimit
+	}
+
+	if o.InitialLimit < o.MinLimit {
+		o.InitialLimit = o.MinLimit
+	}
+
+	if o.InitialLimit > o.MaxLimit {
+		o.InitialLimit = o.MaxLimit
+	}
+
+	if o.Backoff <= 0 || o.Backoff >= 1 {
+		o.Backoff = defaultBackoff
+	}
+
+	if o.RetryAfter <= 0 {
+		o.RetryAfter = defaultRetryAfter
+	}
+
+	if o.MaxKeys <= 0 {
+		o.MaxKeys = defaultMaxShedKeys
+	}
+
+	return o
+}
+
+// RouteKey partitions a LoadShedder by the route pattern, as far as it is
+// known when the shedder runs. Wrap the handlers, or use the mux's .Use,
+// for the pattern to be known.
+func RouteKey(r *http.Request) string {
+	return figureOutLabelMaker(r, nil)[labelPer]
+}
+
+// aimdLimiter is an additive-increase/multiplicative-decrease concurrency
+// limit, the way TCP handles congestion: every on-time completion grows
+// the limit by 1/limit, so by one per limit worth of completions, and a
+// slow one shrinks it by the backoff factor, at most once per round trip.
+type aimdLimiter struct {
+	mu        sync.Mutex
+	limit     float64
+	inFlight  int
+	backedOff time.Time // when the limit was last backed off.
+}
+
+func (l *aimdLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight >= int(l.limit) {
+		return false
+	}
+
+	l.inFlight++
+	return true
+}
+
+// release accounts a request that ran from start to end. The requests
+// that were admitted before the last back off are what caused it, so
+// their being slow too does not back the limit off again, else N slow
+// completions would cut it by Backoff^N.
+func (l *aimdLimiter) release(o ShedOptions, start, end time.Time, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	if end.Sub(start) > o.TargetLatency {
+		if start.After(l.backedOff) {
+			l.limit = math.Max(float64(o.MinLimit), l.limit*o.Backoff)
+			l.backedOff = end
+		}
+		return
+	}
+
+	if failed {
+		return
+	}
+
+	l.limit = math.Min(float64(o.MaxLimit), l.limit+1/l.limit)
+}
+
+// LoadShedder rejects requests beyond an adaptive concurrency limit with a
+// 503 and a Retry-After, instead of letting them queue up while a
+// downstream is degraded. Shed requests are recorded with status="shed".
+// How to use?
+// ls, err := httpmetrics.NewLoadShedder(httpmetrics.ShedOptions{TargetLatency: d})
+// srv := REDHandler(ls.Handler(mux)) or m.Use(REDHandler, ls.Handler)
+type LoadShedder struct {
+	opts ShedOptions
+
+	mu       sync.Mutex
+	limiters map[string]*aimdLimiter
+}
+
+// NewLoadShedder returns a LoadShedder, whose limits are shared by every
+// handler that it wraps.
+func NewLoadShedder(o ShedOptions) (*LoadShedder, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &LoadShedder{
+		opts:     o.withDefaults(),
+		limiters: map[string]*aimdLimiter{},
+	}, nil
+}
+
+func (ls *LoadShedder) limiter(r *http.Request) *aimdLimiter {
+	var key string
+	if ls.opts.Key != nil {
+		key = ls.opts.Key(r)
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	l, ok := ls.limiters[key]
+	if ok {
+		return l
+	}
+
+	if len(ls.limiters) >= ls.opts.MaxKeys {
+		key = overflowShedKey
+		if l, ok = ls.limiters[key]; ok {
+			return l
+		}
+	}
+
+	l = &aimdLimiter{limit: float64(ls.opts.InitialLimit)}
+	ls.limiters[key] = l
+	return l
+}
+
+// Limit returns the current limit of a partition, "" being the global one.
+func (ls *LoadShedder) Limit(key string) int {
+	ls.mu.Lock()
+	l, ok := ls.limiters[key]
+	ls.mu.Unlock()
+
+	if !ok {
+		return ls.opts.InitialLimit
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// Handler wraps next with the adaptive limit. It has the signature that
+// the muxes with a .Use expect.
+func (ls *LoadShedder) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		l := ls.limiter(r)
+		if !l.acquire() {
+			ls.shed(w, r, next, start)
+			return
+		}
+
+		rw := NewResponseWriter(w)
+		defer FinishResponseWriter(rw)
+
+		defer func() {
+			l.release(ls.opts, start, time.Now(), isFailure(rw.code))
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// shed rejects the request. If a REDHandler is measuring it, the status is
+// overridden there, otherwise it is recorded right here.
+func (ls *LoadShedder) shed(
+	w http.ResponseWriter, r *http.Request, next http.Handler, start time.Time,
+) {
+	secs := int(math.Ceil(ls.opts.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, "overloaded, retry later", http.StatusServiceUnavailable)
+
+	if m := measurementFrom(r.Context()); m != nil {
+		m.setStatus(statusShed)
+		return
+	}
+
+	labels := baseLabels(r)
+	labels[labelPer] = figureOutLabelMaker(r, next)[labelPer]
+	labels[labelStatus] = statusShed
+
+	d := time.Since(start)
+	httpRequestsDuration.Observe(labels, d)
+	observeWindow(labels, d, true)
+}
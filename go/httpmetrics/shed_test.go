@@ -0,0 +1,138 @@
+package httpmetrics
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/last9/last9-cdk/go/tests"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestLoadShedder(t *testing.T) {
+	t.Run("excess requests are shed and recorded", func(t *testing.T) {
+		resetMetrics()
+
+		entered := make(chan struct{})
+		unblock := make(chan struct{})
+		ls, err := NewLoadShedder(ShedOptions{
+			TargetLatency: time.Second, InitialLimit: 1, MaxLimit: 1,
+			RetryAfter: 2 * time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/api/", ls.Handler(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				entered <- struct{}{}
+				<-unblock
+				w.WriteHeader(http.StatusOK)
+			},
+		)))
+
+		srv := tests.MakeServer(REDHandler(bindMetrics(mux)))
+		defer srv.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			res, err := http.Get(srv.URL + "/api/1")
+			if err == nil {
+				res.Body.Close()
+			}
+		}()
+
+		<-entered
+		res, err := http.Get(srv.URL + "/api/2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		assert.Equal(t, "2", res.Header.Get("Retry-After"))
+
+		close(unblock)
+		<-done
+
+		o, err := tests.GetMetrics(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		statuses := map[string]uint64{}
+		for _, m := range o["http_requests_duration_milliseconds"].GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == labelStatus {
+					statuses[l.GetValue()] += m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+
+		assert.Equal(t, uint64(1), statuses["200"])
+		assert.Equal(t, uint64(1), statuses[statusShed])
+	})
+
+	t.Run("limit backs off when slow and grows when on time", func(t *testing.T) {
+		o := ShedOptions{TargetLatency: 10 * time.Millisecond}.withDefaults()
+		l := &aimdLimiter{limit: 10}
+		now := time.Now()
+
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, true, l.acquire())
+			l.release(o, now, now.Add(time.Millisecond), false)
+		}
+		assert.Equal(t, 10, int(l.limit))
+		assert.Equal(t, true, l.limit > 10.9)
+
+		l.acquire()
+		l.release(o, now, now.Add(time.Second), false)
+		assert.Equal(t, true, l.limit < 10)
+
+		// a fast 5xx is bad input more often than overload.
+		limit := l.limit
+		l.acquire()
+		l.release(o, now, now.Add(time.Millisecond), true)
+		assert.Equal(t, limit, l.limit)
+
+		// a slow one, admitted after the back off, backs off again.
+		later := now.Add(2 * time.Second)
+		l.acquire()
+		l.release(o, later, later.Add(time.Second), true)
+		assert.Equal(t, true, l.limit < limit)
+	})
+
+	t.Run("concurrent slow completions back off once", func(t *testing.T) {
+		o := ShedOptions{TargetLatency: 10 * time.Millisecond}.withDefaults()
+		l := &aimdLimiter{limit: 20}
+		start := time.Now()
+
+		for i := 0; i < 20; i++ {
+			assert.Equal(t, true, l.acquire())
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l.release(o, start, start.Add(time.Second), false)
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, 20*o.Backoff, l.limit)
+		assert.Equal(t, 0, l.inFlight)
+	})
+
+	t.Run("target latency is required", func(t *testing.T) {
+		_, err := NewLoadShedder(ShedOptions{})
+		assert.NotEqual(t, nil, err)
+
+		_, err = NewLoadShedder(ShedOptions{TargetLatency: -time.Second})
+		assert.NotEqual(t, nil, err)
+	})
+}
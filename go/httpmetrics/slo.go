@@ -0,0 +1,266 @@
+package httpmetrics
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/last9/last9-cdk/go/proc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultBurnWindows are the windows of the burn-rate gauges: pairs of a
+// long and a short window (1h & 5m, 6h & 30m) make for the usual
+// multi-window, multi-burn-rate alerts.
+var DefaultBurnWindows = []time.Duration{
+	5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour,
+}
+
+// SLO is an objective for the requests of a route. A request is a good
+// event if it did not fail with a 5xx and, if Latency is set, it was not
+// slower than Latency. Requests shed by a LoadShedder are bad events.
+type SLO struct {
+	// Name identifies the SLO in the slo label. Names are global, the first
+	// definition of a name wins. Required.
+	Name string
+
+	// Route is matched against the per label using path.Match, like
+	// "/api/*". Method, if set, has to match too. Empty matches all.
+	Route  string
+	Method string
+
+	// Latency threshold, zero makes it an availability only SLO.
+	Latency time.Duration
+
+	// Target is the ratio of good events, 0.999 being three nines. Required.
+	Target float64
+
+	// Windows of the burn-rate gauges. Default to DefaultBurnWindows
+	Windows []time.Duration
+}
+
+// Validate reports what's wrong with the SLO, if anything.
+func (s SLO) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("slo: name is required")
+	}
+
+	if s.Target <= 0 || s.Target >= 1 {
+		return fmt.Errorf("slo %v: target %v is not in (0, 1)", s.Name, s.Target)
+	}
+
+	for _, w := range s.Windows {
+		if w <= 0 {
+			return fmt.Errorf("slo %v: window %v is not positive", s.Name, w)
+		}
+	}
+
+	return nil
+}
+
+// isGood tells a good event from a bad one.
+func (s SLO) isGood(d time.Duration, failed bool) bool {
+	return !failed && (s.Latency <= 0 || d <= s.Latency)
+}
+
+// windowLabel formats 30m0s as 30m, the way PromQL spells durations.
+func windowLabel(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+
+	return fmt.Sprintf("%ds", d/time.Second)
+}
+
+// sloTracker counts the bad events of an SLO over its longest window. The
+// rolling histogram has no buckets, its errors being the bad events.
+type sloTracker struct {
+	slo  SLO
+	hist *proc.RollingHistogram
+}
+
+func newSLOTracker(s SLO) *sloTracker {
+	if len(s.Windows) == 0 {
+		s.Windows = DefaultBurnWindows
+	}
+
+	s.Windows = append([]time.Duration(nil), s.Windows...)
+	sort.Slice(s.Windows, func(i, j int) bool {
+		return s.Windows[i] < s.Windows[j]
+	})
+
+	// a tenth of the shortest window is fine grained enough, while the
+	// ring stays in the hundreds of slots for the defaults.
+	resolution := s.Windows[0] / 10
+	if resolution < time.Second {
+		resolution = time.Second
+	}
+
+	return &sloTracker{
+		slo:  s,
+		hist: proc.NewRollingHistogram(nil, resolution, s.Windows[len(s.Windows)-1]),
+	}
+}
+
+func (t *sloTracker) record(labels map[string]string, d time.Duration, failed bool) {
+	if !matchRoute(t.slo.Route, t.slo.Method, labels) {
+		return
+	}
+
+	good := t.slo.isGood(d, failed)
+	t.hist.Observe(d, !good)
+
+	l := prometheus.Labels{
+		"slo":              t.slo.Name,
+		proc.LabelProgram:  proc.GetProgamName(),
+		proc.LabelHostname: proc.GetHostname(),
+	}
+
+	httpSLOEvents.With(l).Inc()
+	if good {
+		httpSLOGoodEvents.With(l).Inc()
+	}
+}
+
+// burnRate is how fast the error budget is being spent, 1 being exactly
+// at the pace that would exhaust it by the end of the SLO period.
+func (t *sloTracker) burnRate(window time.Duration) float64 {
+	s := t.hist.Snapshot(window)
+	return s.ErrorRatio / (1 - t.slo.Target)
+}
+
+// sloRegistry holds the trackers of every SLO that a middleware declared
+// and exposes their burn rates as gauges, computed at scrape time.
+type sloRegistry struct {
+	mu       sync.Mutex
+	trackers map[string]*sloTracker
+
+	burnRate  *prometheus.Desc
+	objective *prometheus.Desc
+}
+
+var (
+	sloLabels = []string{"slo", proc.LabelProgram, proc.LabelHostname}
+
+	httpSLOEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_slo_events_total",
+			Help: "HTTP requests that an SLO accounts for",
+		},
+		sloLabels,
+	)
+
+	httpSLOGoodEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_slo_good_events_total",
+			Help: "HTTP requests that met an SLO",
+		},
+		sloLabels,
+	)
+
+	slos = &sloRegistry{
+		trackers: map[string]*sloTracker{},
+		burnRate: prometheus.NewDesc(
+			"http_slo_burn_rate",
+			"Error budget burn rate of an SLO over a window",
+			append([]string{"window"}, sloLabels...), nil,
+		),
+		objective: prometheus.NewDesc(
+			"http_slo_objective",
+			"Target ratio of good events of an SLO",
+			sloLabels, nil,
+		),
+	}
+)
+
+func init() {
+	prometheus.MustRegister(httpSLOEvents, httpSLOGoodEvents, slos)
+}
+
+// track returns the trackers of the SLOs, registering those not yet seen.
+// It panics on an invalid SLO, like prometheus.MustRegister does, as this
+// happens when the middleware is set up.
+func (r *sloRegistry) track(defs []SLO) []*sloTracker {
+	if len(defs) == 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]*sloTracker, 0, len(defs))
+	for _, s := range defs {
+		if err := s.Validate(); err != nil {
+			panic(err)
+		}
+
+		t, ok := r.trackers[s.Name]
+		if !ok {
+			t = newSLOTracker(s)
+			r.trackers[s.Name] = t
+		}
+
+		out = append(out, t)
+	}
+
+	return out
+}
+
+// Describe implements prometheus.Collector
+func (r *sloRegistry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.burnRate
+	ch <- r.objective
+}
+
+// Collect implements prometheus.Collector
+func (r *sloRegistry) Collect(ch chan<- prometheus.Metric) {
+	r.mu.Lock()
+	trackers := make([]*sloTracker, 0, len(r.trackers))
+	for _, t := range r.trackers {
+		trackers = append(trackers, t)
+	}
+	r.mu.Unlock()
+
+	program, hostname := proc.GetProgamName(), proc.GetHostname()
+	for _, t := range trackers {
+		ch <- prometheus.MustNewConstMetric(
+			r.objective, prometheus.GaugeValue, t.slo.Target,
+			t.slo.Name, program, hostname,
+		)
+
+		for _, w := range t.slo.Windows {
+			ch <- prometheus.MustNewConstMetric(
+				r.burnRate, prometheus.GaugeValue, t.burnRate(w),
+				windowLabel(w), t.slo.Name, program, hostname,
+			)
+		}
+	}
+}
+
+// Reset forgets every SLO, along with its counters.
+func (r *sloRegistry) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.trackers = map[string]*sloTracker{}
+	httpSLOEvents.Reset()
+	httpSLOGoodEvents.Reset()
+}
+
+// BurnRate returns the current burn rate of a declared SLO over a window,
+// for the code that wants to act on it, like a readiness check.
+func BurnRate(name string, window time.Duration) (float64, error) {
+	slos.mu.Lock()
+	t, ok := slos.trackers[name]
+	slos.mu.Unlock()
+
+	if !ok {
+		return 0, fmt.Errorf("slo %v is not declared", name)
+	}
+
+	return t.burnRate(window), nil
+}
@@ -0,0 +1,72 @@
+package httpmetrics
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/last9/last9-cdk/go/proc"
+	"github.com/last9/last9-cdk/go/tests"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestSLO(t *testing.T) {
+	resetMetrics()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", basicHandler())
+	mux.Handle("/fail/", failingHandler())
+
+	o := Options{SLOs: []SLO{
+		{Name: "api", Route: "/api/", Target: 0.99},
+		{Name: "all", Target: 0.9, Windows: []time.Duration{time.Minute}},
+	}}
+
+	srv := tests.MakeServer(REDHandlerWithOptions(o)(mux))
+	defer srv.Close()
+
+	if _, err := tests.SendTestRequests(srv.URL, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(srv.URL + "/fail/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	p, h := proc.GetProgamName(), proc.GetHostname()
+	api := httpSLOEvents.WithLabelValues("api", p, h)
+	all := httpSLOEvents.WithLabelValues("all", p, h)
+	good := httpSLOGoodEvents.WithLabelValues("all", p, h)
+	assert.Equal(t, 3.0, testutil.ToFloat64(api))
+	assert.Equal(t, 4.0, testutil.ToFloat64(all))
+	assert.Equal(t, 3.0, testutil.ToFloat64(good))
+
+	// 1 in 4 is bad, against a budget of 1 in 10.
+	br, err := BurnRate("all", time.Minute)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, br > 2.49 && br < 2.51)
+
+	br, _ = BurnRate("api", 5*time.Minute)
+	assert.Equal(t, 0.0, br)
+
+	_, err = BurnRate("missing", time.Minute)
+	assert.NotEqual(t, nil, err)
+
+	// 1 objective + 4 default windows, and 1 objective + 1 window.
+	assert.Equal(t, 7, testutil.CollectAndCount(slos))
+}
+
+func TestSLOLatency(t *testing.T) {
+	s := SLO{Name: "fast", Target: 0.9, Latency: 100 * time.Millisecond}
+	assert.Equal(t, true, s.isGood(50*time.Millisecond, false))
+	assert.Equal(t, false, s.isGood(150*time.Millisecond, false))
+	assert.Equal(t, false, s.isGood(50*time.Millisecond, true))
+
+	assert.NotEqual(t, nil, SLO{Name: "x", Target: 1}.Validate())
+	assert.NotEqual(t, nil, SLO{Target: 0.9}.Validate())
+	assert.Equal(t, "30m", windowLabel(30*time.Minute))
+	assert.Equal(t, "6h", windowLabel(6*time.Hour))
+}
@@ -0,0 +1,53 @@
+package httpmetrics
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/last9/last9-cdk/go/proc"
+)
+
+// requestWindows mirrors httpRequestsDuration in-process, over a sliding
+// window, for the consumers that cannot wait on a scrape. The status does
+// not split a series, a 5xx is what counts as an error instead. Neither
+// does the caller, the consumers care about the route.
+var requestWindows = proc.NewRollingSet(proc.RollingOptions{
+	Ignore: []string{labelStatus, labelL6etenant, labelCaller},
+})
+
+// snapshots is set by EnableSnapshots. Until then requests are not
+// mirrored, as every label set costs a ring of slots of its own.
+var snapshots int32
+
+// EnableSnapshots starts mirroring requests in to the windows that
+// Snapshot reads. NewReadiness calls it, nothing else needs to.
+// How to use?
+// httpmetrics.EnableSnapshots() // before the traffic starts
+func EnableSnapshots() {
+	atomic.StoreInt32(&snapshots, 1)
+}
+
+// observeWindow mirrors a request, if snapshots were enabled.
+func observeWindow(labels map[string]string, d time.Duration, failed bool) {
+	if atomic.LoadInt32(&snapshots) == 1 {
+		requestWindows.Observe(labels, d, failed)
+	}
+}
+
+// isFailure is what a request has to be, to count against the error ratio.
+func isFailure(code int) bool {
+	return code >= http.StatusInternalServerError
+}
+
+// Snapshot returns the rate, the ratio of 5xx responses and interpolated
+// latency quantiles of every label set that saw traffic in the window.
+// The window is rounded up to proc.DefaultRollingResolution and is capped
+// at proc.DefaultRollingSpan. It is empty unless EnableSnapshots was
+// called.
+// How to use?
+// snaps := httpmetrics.Snapshot(time.Minute)
+// where snaps[i].Labels["per"] is the route and snaps[i].P99 is its p99.
+func Snapshot(window time.Duration) []proc.LabeledSnapshot {
+	return requestWindows.Snapshot(window)
+}
@@ -0,0 +1,67 @@
+package httpmetrics
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/last9/last9-cdk/go/tests"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func failingHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	resetMetrics()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", basicHandler())
+	mux.Handle("/fail/", failingHandler())
+	srv := tests.MakeServer(REDHandler(mux))
+	defer srv.Close()
+
+	// nothing is mirrored until snapshots are enabled.
+	atomic.StoreInt32(&snapshots, 0)
+	if _, err := tests.SendTestRequests(srv.URL, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 0, len(requestWindows.Snapshot(time.Minute)))
+
+	EnableSnapshots()
+	if _, err := tests.SendTestRequests(srv.URL, 6); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		res, err := http.Get(srv.URL + "/fail/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	snaps := map[string]uint64{}
+	for _, s := range Snapshot(time.Minute) {
+		snaps[s.Labels[labelPer]] = s.Count
+		_, hasStatus := s.Labels[labelStatus]
+		assert.Equal(t, false, hasStatus)
+
+		switch s.Labels[labelPer] {
+		case "/api/":
+			assert.Equal(t, 0.0, s.ErrorRatio)
+			assert.Equal(t, true, s.P99 > 0)
+			assert.Equal(t, true, s.P50 <= s.P99)
+		case "/fail/":
+			assert.Equal(t, 1.0, s.ErrorRatio)
+		}
+	}
+
+	assert.Equal(t, uint64(6), snaps["/api/"])
+	assert.Equal(t, uint64(2), snaps["/fail/"])
+}
@@ -0,0 +1,68 @@
+package httpmetrics
+
+import (
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/last9/last9-cdk/go/httpmetrics"
+
+// tracer defaults to the global provider, which is a no-op until the
+// application sets one with otel.SetTracerProvider.
+func (o Options) tracer() trace.Tracer {
+	if o.TracerProvider != nil {
+		return o.TracerProvider.Tracer(tracerName)
+	}
+
+	return otel.Tracer(tracerName)
+}
+
+// propagator defaults to the W3C trace context.
+func propagatorOr(p propagation.TextMapPropagator) propagation.TextMapPropagator {
+	if p != nil {
+		return p
+	}
+
+	return propagation.TraceContext{}
+}
+
+// startSpan starts the server span of a request, as a child of the trace
+// context that the caller sent along, if any. Its name is set once the
+// route is known, read endSpan.
+func startSpan(
+	t trace.Tracer, p propagation.TextMapPropagator, r *http.Request,
+) (*http.Request, trace.Span) {
+	ctx := p.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := t.Start(ctx, "HTTP "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("server.address", r.Host),
+			attribute.String("client.address", r.RemoteAddr),
+		),
+	)
+
+	return r.WithContext(ctx), span
+}
+
+// endSpan names the span after the templated route, the per label, rather
+// than the raw URL, to keep the span names few.
+func endSpan(span trace.Span, labels map[string]string, code int) {
+	span.SetName(labels[labelMethod] + " " + labels[labelPer])
+	span.SetAttributes(
+		attribute.String("http.route", labels[labelPer]),
+		attribute.Int("http.response.status_code", code),
+	)
+
+	if isFailure(code) {
+		span.SetStatus(codes.Error, strconv.Itoa(code))
+	}
+
+	span.End()
+}
@@ -0,0 +1,67 @@
+package httpmetrics
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/last9/last9-cdk/go/tests"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestTrace(t *testing.T) {
+	resetMetrics()
+
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	defer func() { _ = tp.Shutdown(context.Background()) }()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", basicHandler())
+	mux.Handle("/fail/", failingHandler())
+
+	o := Options{TracerProvider: tp}
+	srv := tests.MakeServer(REDHandlerWithOptions(o)(mux))
+	defer srv.Close()
+
+	// the client's span is the parent, its context travels with the request.
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "client")
+	c := &http.Client{Transport: NewCallerTransport(nil)}
+	for _, p := range []string{"/api/1", "/fail/2"} {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+p, nil)
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	parent.End()
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, s := range exp.GetSpans() {
+		spans[s.Name] = s
+	}
+
+	api, ok := spans["GET /api/"]
+	assert.Equal(t, true, ok)
+	assert.Equal(t, trace.SpanKindServer, api.SpanKind)
+	assert.Equal(t, parent.SpanContext().TraceID(), api.SpanContext.TraceID())
+	assert.Equal(t, parent.SpanContext().SpanID(), api.Parent.SpanID())
+	assert.Equal(t, codes.Unset, api.Status.Code)
+
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, a := range api.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	assert.Equal(t, "/api/", attrs["http.route"].AsString())
+	assert.Equal(t, int64(200), attrs["http.response.status_code"].AsInt64())
+
+	fail, ok := spans["GET /fail/"]
+	assert.Equal(t, true, ok)
+	assert.Equal(t, codes.Error, fail.Status.Code)
+}
@@ -0,0 +1,65 @@
+package httpmetrics
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/last9/last9-cdk/go/proc"
+	"github.com/last9/last9-cdk/go/tests"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestDurationUnits(t *testing.T) {
+	t.Run("sub-millisecond durations are not truncated", func(t *testing.T) {
+		resetMetrics()
+
+		mux := http.NewServeMux()
+		mux.Handle("/api/", basicHandler())
+		srv := tests.MakeServer(REDHandler(bindMetrics(mux)))
+		defer srv.Close()
+
+		if _, err := tests.SendTestRequests(srv.URL, 5); err != nil {
+			t.Fatal(err)
+		}
+
+		o, err := tests.GetMetrics(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := o["http_requests_duration_milliseconds"].GetMetric()[0].GetHistogram()
+		assert.Equal(t, 5, int(h.GetSampleCount()))
+		assert.Equal(t, true, h.GetSampleSum() > 0)
+	})
+
+	t.Run("dual emit milliseconds and seconds", func(t *testing.T) {
+		resetMetrics()
+		SetDurationUnits(proc.Milliseconds, proc.Seconds)
+		defer SetDurationUnits(proc.Milliseconds)
+
+		mux := http.NewServeMux()
+		mux.Handle("/api/", basicHandler())
+		srv := tests.MakeServer(REDHandler(bindMetrics(mux)))
+		defer srv.Close()
+
+		if _, err := tests.SendTestRequests(srv.URL, 3); err != nil {
+			t.Fatal(err)
+		}
+
+		o, err := tests.GetMetrics(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ms := o["http_requests_duration_milliseconds"]
+		s := o["http_requests_duration_seconds"]
+		assert.Equal(t, 1, len(s.GetMetric()))
+		assert.Equal(t, 7, assertLabels("/api/", getDomain(srv), s))
+
+		msh := ms.GetMetric()[0].GetHistogram()
+		sh := s.GetMetric()[0].GetHistogram()
+		assert.Equal(t, msh.GetSampleCount(), sh.GetSampleCount())
+		assert.Equal(t, true, sh.GetSampleSum() < msh.GetSampleSum())
+		assert.Equal(t, 0.00025, sh.GetBucket()[0].GetUpperBound())
+	})
+}
@@ -0,0 +1,87 @@
+package proc
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+)
+
+// BuildVersion, BuildCommit and BuildTime are reported by the /version
+// endpoint. Stamp them at link time, for example
+// go build -ldflags "-X github.com/last9/last9-cdk/go/proc.BuildCommit=abc"
+// BuildVersion falls back to the main module version when left empty.
+var (
+	BuildVersion string
+	BuildCommit  string
+	BuildTime    string
+)
+
+const (
+	pprofPath   = "/debug/pprof/"
+	expvarPath  = "/debug/vars"
+	versionPath = "/version"
+)
+
+// versionInfo is what the /version endpoint responds with.
+type versionInfo struct {
+	Program   string `json:"program"`
+	Hostname  string `json:"hostname"`
+	Module    string `json:"module,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+func getVersionInfo() versionInfo {
+	v := versionInfo{
+		Program:   GetProgamName(),
+		Hostname:  GetHostname(),
+		Version:   BuildVersion,
+		Commit:    BuildCommit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		v.Module = bi.Main.Path
+		if v.Version == "" {
+			v.Version = bi.Main.Version
+		}
+	}
+
+	return v
+}
+
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(getVersionInfo())
+}
+
+// registerDebug wires the debug endpoints that were asked for. All of
+// them go through Handle, hence sit behind the same auth as /metrics.
+//
+// NOTE: importing net/http/pprof and expvar also registers their handlers
+// on http.DefaultServeMux. Processes that serve the DefaultServeMux to the
+// outside world should not, and that is one more reason to use a
+// MetricsServer, which never does.
+func (s *MetricsServer) registerDebug() {
+	if s.opts.EnablePprof {
+		s.Handle(pprofPath, http.HandlerFunc(pprof.Index))
+		s.Handle(pprofPath+"cmdline", http.HandlerFunc(pprof.Cmdline))
+		s.Handle(pprofPath+"profile", http.HandlerFunc(pprof.Profile))
+		s.Handle(pprofPath+"symbol", http.HandlerFunc(pprof.Symbol))
+		s.Handle(pprofPath+"trace", http.HandlerFunc(pprof.Trace))
+	}
+
+	if s.opts.EnableExpvar {
+		s.Handle(expvarPath, expvar.Handler())
+	}
+
+	if s.opts.EnableVersion {
+		s.Handle(versionPath, http.HandlerFunc(serveVersion))
+	}
+}
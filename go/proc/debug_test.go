@@ -0,0 +1,87 @@
+package proc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	paths := []string{pprofPath, pprofPath + "cmdline", expvarPath, versionPath}
+
+	t.Run("disabled", func(t *testing.T) {
+		s := newTestServer(t, ServerOptions{})
+		for _, p := range paths {
+			assert.Equal(t, http.StatusNotFound, get(s, p, nil))
+		}
+	})
+
+	t.Run("enabled one at a time", func(t *testing.T) {
+		for _, tc := range []struct {
+			o       ServerOptions
+			enabled []string
+		}{
+			{ServerOptions{EnablePprof: true}, paths[:2]},
+			{ServerOptions{EnableExpvar: true}, paths[2:3]},
+			{ServerOptions{EnableVersion: true}, paths[3:]},
+		} {
+			s := newTestServer(t, tc.o)
+			for _, p := range paths {
+				want := http.StatusNotFound
+				for _, e := range tc.enabled {
+					if p == e {
+						want = http.StatusOK
+					}
+				}
+
+				assert.Equal(t, want, get(s, p, nil))
+			}
+		}
+	})
+
+	t.Run("behind auth", func(t *testing.T) {
+		s := newTestServer(t, ServerOptions{
+			BearerToken:   "token",
+			EnablePprof:   true,
+			EnableExpvar:  true,
+			EnableVersion: true,
+		})
+
+		auth := func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer token")
+		}
+
+		for _, p := range paths {
+			assert.Equal(t, http.StatusUnauthorized, get(s, p, nil))
+			assert.Equal(t, http.StatusOK, get(s, p, auth))
+		}
+	})
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	BuildVersion, BuildCommit, BuildTime = "v1.2.3", "abc", "2021-12-09"
+	defer func() { BuildVersion, BuildCommit, BuildTime = "", "", "" }()
+
+	s := newTestServer(t, ServerOptions{EnableVersion: true})
+
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, versionPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var v versionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, GetProgamName(), v.Program)
+	assert.Equal(t, GetHostname(), v.Hostname)
+	assert.Equal(t, "v1.2.3", v.Version)
+	assert.Equal(t, "abc", v.Commit)
+	assert.Equal(t, "2021-12-09", v.BuildTime)
+	assert.Equal(t, runtime.Version(), v.GoVersion)
+}
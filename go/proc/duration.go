@@ -0,0 +1,275 @@
+package proc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DurationUnit is the base unit that a duration gets recorded in.
+type DurationUnit int
+
+const (
+	// Milliseconds is what the CDK has always emitted, hence the default.
+	Milliseconds DurationUnit = iota
+	// Seconds is what the Prometheus naming conventions recommend.
+	Seconds
+)
+
+// String method on DurationUnit comes handy as a metric name suffix.
+func (u DurationUnit) String() string {
+	return [...]string{"milliseconds", "seconds"}[u]
+}
+
+// Of converts a duration in to this unit with full precision. Unlike
+// float64(d.Milliseconds()) a 300µs request is recorded as 0.3 and not 0.
+func (u DurationUnit) Of(d time.Duration) float64 {
+	if u == Seconds {
+		return d.Seconds()
+	}
+
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Buckets converts bucket boundaries, expressed in milliseconds like
+// LatencyBins are, in to this unit.
+func (u DurationUnit) Buckets(ms []float64) []float64 {
+	if u == Milliseconds {
+		return ms
+	}
+
+	out := make([]float64, len(ms))
+	for i, b := range ms {
+		out[i] = b / 1000
+	}
+
+	return out
+}
+
+// DurationHistogramOpts describe a DurationHistogram. Name is the metric
+// name without the unit, which is appended as a suffix per unit.
+type DurationHistogramOpts struct {
+	Namespace string
+	Subsystem string
+	Name      string
+	Help      string
+
+	// Buckets in milliseconds. Defaults to LatencyBins
+	Buckets []float64
+}
+
+// DurationHistogram is a prometheus.Collector that records a duration in
+// every enabled unit. It lets dashboards migrate from _milliseconds to
+// _seconds while both are being emitted, one histogram per unit.
+type DurationHistogram struct {
+	opts   DurationHistogramOpts
+	labels []string
+
+	// optional are the labels, among labels, that an observation may leave
+	// out. They are recorded empty.
+	optional []string
+
+	mu    sync.RWMutex
+	vecs  map[DurationUnit]*prometheus.HistogramVec
+	units []DurationUnit
+}
+
+// NewDurationHistogram returns a DurationHistogram that records in
+// Milliseconds until told otherwise via SetUnits.
+func NewDurationHistogram(
+	opts DurationHistogramOpts, labels []string,
+) *DurationHistogram {
+	if len(opts.Buckets) == 0 {
+		opts.Buckets = LatencyBins
+	}
+
+	h := &DurationHistogram{
+		opts:   opts,
+		labels: labels,
+		units:  []DurationUnit{Milliseconds},
+	}
+
+	h.vecs = h.makeVecs(opts.Buckets)
+	return h
+}
+
+func (h *DurationHistogram) makeVecs(
+	buckets []float64,
+) map[DurationUnit]*prometheus.HistogramVec {
+	out := map[DurationUnit]*prometheus.HistogramVec{}
+	for _, u := range []DurationUnit{Milliseconds, Seconds} {
+		out[u] = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name: prometheus.BuildFQName(
+					h.opts.Namespace,
+					h.opts.Subsystem,
+					h.opts.Name+"_"+u.String(),
+				),
+				Help:    h.opts.Help,
+				Buckets: u.Buckets(buckets),
+			},
+			h.labels,
+		)
+	}
+
+	return out
+}
+
+// SetBuckets replaces the bucket layout, expressed in milliseconds. Every
+// series recorded so far is dropped, so call it before serving traffic.
+func (h *DurationHistogram) SetBuckets(ms []float64) error {
+	if err := ValidateBuckets(ms); err != nil {
+		return err
+	}
+
+	ms = append([]float64(nil), ms...)
+	vecs := h.makeVecs(ms)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.opts.Buckets = ms
+	h.vecs = vecs
+	return nil
+}
+
+// AddLabels adds the names to the labels of the histogram, for the
+// observations that may or may not carry them. Those that do not are
+// recorded with the label empty. Adding a name that is new drops every
+// series recorded so far, so call it before serving traffic.
+func (h *DurationHistogram) AddLabels(names ...string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	added := false
+	for _, n := range names {
+		if !validLabelName(n) {
+			return fmt.Errorf("label %q: not a valid label name", n)
+		}
+
+		if hasLabel(h.labels, n) {
+			continue
+		}
+
+		h.labels = append(append([]string(nil), h.labels...), n)
+		h.optional = append(h.optional, n)
+		added = true
+	}
+
+	if added {
+		h.vecs = h.makeVecs(h.opts.Buckets)
+	}
+
+	return nil
+}
+
+// validLabelName follows the Prometheus data model, [a-zA-Z_][a-zA-Z0-9_]*
+// without the __ prefix that is reserved for internal use.
+func validLabelName(n string) bool {
+	if n == "" || len(n) > 1 && n[:2] == "__" {
+		return false
+	}
+
+	for i, c := range n {
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' && i > 0 {
+			continue
+		}
+
+		return false
+	}
+
+	return true
+}
+
+func hasLabel(labels []string, n string) bool {
+	for _, l := range labels {
+		if l == n {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetUnits chooses the units that subsequent observations are recorded
+// in. Passing both Milliseconds and Seconds dual-emits. An empty list
+// falls back to Milliseconds.
+func (h *DurationHistogram) SetUnits(units ...DurationUnit) {
+	if len(units) == 0 {
+		units = []DurationUnit{Milliseconds}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.units = append([]DurationUnit(nil), units...)
+}
+
+// Observe records d against the labels, in every enabled unit.
+func (h *DurationHistogram) Observe(labels prometheus.Labels, d time.Duration) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	labels = h.withOptional(labels)
+	for _, u := range h.units {
+		h.vecs[u].With(labels).Observe(u.Of(d))
+	}
+}
+
+// withOptional returns the labels, with the optional ones that are missing
+// set empty, copied only if any is.
+func (h *DurationHistogram) withOptional(labels prometheus.Labels) prometheus.Labels {
+	var out prometheus.Labels
+	for _, n := range h.optional {
+		if _, ok := labels[n]; ok {
+			continue
+		}
+
+		if out == nil {
+			out = make(prometheus.Labels, len(labels)+len(h.optional))
+			for k, v := range labels {
+				out[k] = v
+			}
+		}
+
+		out[n] = ""
+	}
+
+	if out == nil {
+		return labels
+	}
+
+	return out
+}
+
+// Reset deletes every recorded series.
+func (h *DurationHistogram) Reset() {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, v := range h.vecs {
+		v.Reset()
+	}
+}
+
+// Describe implements prometheus.Collector
+func (h *DurationHistogram) Describe(ch chan<- *prometheus.Desc) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, v := range h.vecs {
+		v.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector. A unit that was never enabled
+// has no series and thus emits nothing.
+func (h *DurationHistogram) Collect(ch chan<- prometheus.Metric) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, v := range h.vecs {
+		v.Collect(ch)
+	}
+}
@@ -1,9 +1,91 @@
 package proc
 
-import "math"
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
 
-var LatencyBins = latencyBins(0.25, 1.5, 31)
+// MaxBuckets bounds the size of a bucket layout. Every bucket is a
+// time-series of its own, per label combination, so a layout is not free.
+const MaxBuckets = 64
 
+// Names of the preset layouts, read PresetBuckets.
+const (
+	PresetDefault  = "default"
+	PresetFastAPI  = "fast-api"
+	PresetDB       = "db"
+	PresetBatchJob = "batch-job"
+)
+
+// LatencyBins is the layout, in milliseconds, that the CDK has always
+// emitted. Its last bucket is a 1h catch-all.
+var LatencyBins = []float64{
+	0.25, 0.5, 1, 1.75, 3, 4.75, 7.5, 11.75, 18, 27.5, 41.75, 63.25, 95.5,
+	144, 216.75, 326, 490, 736.25, 1105.5, 1659.5, 2490.75, 3737.5, 5607.75,
+	8413.25, 12621.75, 18934.5, 28403.5, 42607.25, 63912.75, 95871.25,
+	3600000,
+}
+
+// presets are the named layouts, in milliseconds.
+var presets = map[string]func() ([]float64, error){
+	PresetDefault: func() ([]float64, error) { return ExplicitBuckets(LatencyBins...) },
+	// 0.25ms to ~2.8s, for APIs with single digit millisecond SLOs.
+	PresetFastAPI: func() ([]float64, error) { return GeometricBuckets(0.25, 1.5, 24) },
+	// 0.1ms to ~12.6s, indexed lookups as well as the odd report query.
+	PresetDB: func() ([]float64, error) { return GeometricBuckets(0.1, 1.6, 26) },
+	// 100ms to ~1.9h, for batch jobs and slow third party calls.
+	PresetBatchJob: func() ([]float64, error) { return GeometricBuckets(100, 1.7, 22) },
+}
+
+// PresetBuckets returns a copy of the named layout, in milliseconds.
+// Known names are PresetDefault, PresetFastAPI, PresetDB and
+// PresetBatchJob. A layout applies per package, to httpmetrics.SetBuckets
+// or sqlmetrics.SetBuckets, not per middleware or per driver: every series
+// of a histogram shares one layout, and every middleware, or driver,
+// emits in to the same histogram.
+func PresetBuckets(name string) ([]float64, error) {
+	fn, ok := presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown bucket preset %q", name)
+	}
+
+	return fn()
+}
+
+// ValidateBuckets checks that a layout is usable: not empty, not larger
+// than MaxBuckets, finite, positive and strictly increasing.
+func ValidateBuckets(b []float64) error {
+	if len(b) == 0 {
+		return fmt.Errorf("no buckets")
+	}
+
+	if len(b) > MaxBuckets {
+		return fmt.Errorf("%d buckets, at most %d allowed", len(b), MaxBuckets)
+	}
+
+	for i, v := range b {
+		if math.IsNaN(v) || math.IsInf(v, 0) || v <= 0 {
+			return fmt.Errorf("bucket %d: %v is not a positive number", i, v)
+		}
+
+		if i > 0 && v <= b[i-1] {
+			return fmt.Errorf(
+				"bucket %d: %v does not increase over %v", i, v, b[i-1],
+			)
+		}
+	}
+
+	return nil
+}
+
+// GeometricBuckets returns count buckets where the first one is start and
+// every subsequent one is factor times the previous, rounded to 4
+// significant digits. GeometricBuckets(1, 1.5, 19) yields
+// [1, 1.5, 2.25, 3.375, … 1478]. A factor so close to 1 that two
+// neighbouring buckets round to the same bound is an error.
+//
 // With latency, keeping track of individual measurements is a good, first-pass
 // solution. It gives you the flexibility to perform aggregations at a later
 // time and experiment with different ways of constructing histograms and
@@ -25,7 +107,7 @@ var LatencyBins = latencyBins(0.25, 1.5, 31)
 // difference in buckets in this arithmetic sequence is 2ms. This approach is
 // better than measuring each latency separately, but with fixed-width buckets,
 // it will take roughly 1,000 buckets to measure latencies up to 2000ms. Most
-// of the buckets will be empty, which isn’t ideal.
+// of the buckets will be empty, which isn’t ideal. Read LinearBuckets.
 //
 // **2. Lay Out the Bucket Sizes as a Geometric Sequence**
 // Again, we’ll start with an example:
@@ -38,17 +120,112 @@ var LatencyBins = latencyBins(0.25, 1.5, 31)
 // capture latencies up to 2000ms and each bucket will be used well.
 //
 // Fun Fact
-// A geometric sequence is the default bucketization used at Google to measure
+// A geometric sequence is the default bucketization used at Google to measure
 // latency histograms.
 //
 // Reference Reading
 // - https://twitter.com/el_bhs/status/993819711107485697?lang=en
 // - https://www.circonus.com/2018/08/latency-slos-done-right/
-func latencyBins(stepStart, rate float64, limit int) []float64 {
-	var out = []float64{0}
-	for i := 1; i < limit; i++ {
-		out = append(out, math.Floor((out[len(out)-1]+(stepStart*math.Pow(rate, float64(i-1))))*4)/4)
+func GeometricBuckets(start, factor float64, count int) ([]float64, error) {
+	if start <= 0 || factor <= 1 || count < 1 {
+		return nil, fmt.Errorf(
+			"geometric buckets need start > 0, factor > 1 and count >= 1",
+		)
+	}
+
+	out := make([]float64, count)
+	for i := range out {
+		out[i] = tidy(start*math.Pow(factor, float64(i)), 4)
+		if i > 0 && out[i] <= out[i-1] {
+			return nil, fmt.Errorf(
+				"geometric buckets: factor %v is too small, buckets %d and %d "+
+					"both round to %v at 4 significant digits",
+				factor, i-1, i, out[i],
+			)
+		}
 	}
 
-	return append(out, float64(3600000))[1:]
+	return validated(out)
+}
+
+// LinearBuckets returns count buckets, width apart, the first one being
+// start. LinearBuckets(1, 2, 5) yields [1, 3, 5, 7, 9]
+func LinearBuckets(start, width float64, count int) ([]float64, error) {
+	if start <= 0 || width <= 0 || count < 1 {
+		return nil, fmt.Errorf(
+			"linear buckets need start > 0, width > 0 and count >= 1",
+		)
+	}
+
+	out := make([]float64, count)
+	for i := range out {
+		out[i] = tidy(start+width*float64(i), 12)
+	}
+
+	return validated(out)
+}
+
+// LogLinearBuckets divides every power of 10 between min and max in to
+// steps linear buckets. It is a middle ground between the two approaches
+// above: the relative error stays bounded like a geometric sequence while
+// the boundaries remain human friendly. min and max are always bounds,
+// even when they do not fall on a step.
+// LogLinearBuckets(1, 100, 9) yields [1, 2, … 9, 10, 20, … 90, 100] and
+// LogLinearBuckets(0.5, 30, 3) yields [0.5, 0.7, 1, 4, 7, 10, 30]
+func LogLinearBuckets(min, max float64, steps int) ([]float64, error) {
+	if min <= 0 || max <= min || steps < 1 {
+		return nil, fmt.Errorf(
+			"log-linear buckets need 0 < min < max and steps >= 1",
+		)
+	}
+
+	var out []float64
+	for k := math.Floor(math.Log10(min)); math.Pow(10, k) <= max; k++ {
+		decade := math.Pow(10, k)
+		for i := 0; i < steps; i++ {
+			v := tidy(decade*(1+9*float64(i)/float64(steps)), 12)
+			if v >= min && v <= max {
+				out = append(out, v)
+			}
+		}
+	}
+
+	if len(out) == 0 || out[0] > min {
+		out = append([]float64{min}, out...)
+	}
+
+	if out[len(out)-1] < max {
+		out = append(out, max)
+	}
+
+	return validated(out)
+}
+
+// validated returns the layout only if it passes ValidateBuckets.
+func validated(b []float64) ([]float64, error) {
+	if err := ValidateBuckets(b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// tidy rounds to the significant digits, dropping the floating point noise
+// so that 0.1*3 becomes a bucket labelled le="0.3" and not
+// le="0.30000000000000004"
+func tidy(v float64, digits int) float64 {
+	out, err := strconv.ParseFloat(strconv.FormatFloat(v, 'g', digits, 64), 64)
+	if err != nil {
+		return v
+	}
+
+	return out
+}
+
+// ExplicitBuckets validates a hand written layout, after sorting a copy
+// of it.
+func ExplicitBuckets(bounds ...float64) ([]float64, error) {
+	out := append([]float64(nil), bounds...)
+	sort.Float64s(out)
+	return validated(out)
 }
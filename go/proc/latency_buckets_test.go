@@ -0,0 +1,37 @@
+package proc
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestLogLinearBuckets(t *testing.T) {
+	b, err := LogLinearBuckets(0.5, 30, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []float64{0.5, 0.7, 1, 4, 7, 10, 30}, b)
+
+	b, err = LogLinearBuckets(1, 100, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1.0, b[0])
+	assert.Equal(t, 100.0, b[len(b)-1])
+	assert.Equal(t, 19, len(b))
+}
+
+func TestGeometricBuckets(t *testing.T) {
+	b, err := GeometricBuckets(1, 1.5, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []float64{1, 1.5, 2.25, 3.375}, b)
+
+	// the rounding, not the factor, is what collapses the bounds.
+	_, err = GeometricBuckets(1000, 1.0001, 3)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.Contains(err.Error(), "factor 1.0001 is too small"))
+}
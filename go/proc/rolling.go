@@ -0,0 +1,450 @@
+package proc
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultRollingResolution is the granularity at which a rolling
+	// window slides.
+	DefaultRollingResolution = 10 * time.Second
+	// DefaultRollingSpan is the longest window that can be asked for.
+	DefaultRollingSpan = 5 * time.Minute
+)
+
+// Snapshot summarizes the observations of a sliding window.
+type Snapshot struct {
+	Window     time.Duration
+	Count      uint64
+	Errors     uint64
+	Rate       float64 // observations per second
+	ErrorRatio float64 // Errors / Count
+	Mean       time.Duration
+	P50        time.Duration
+	P95        time.Duration
+	P99        time.Duration
+
+	bounds []float64 // milliseconds, shared with the RollingHistogram.
+	counts []uint64  // per bucket, the last one being +Inf.
+}
+
+// Quantile interpolates the q-th (0 <= q <= 1) quantile linearly within
+// the bucket it falls in, the way PromQL's histogram_quantile does.
+// Observations beyond the last bucket are reported as the last bound.
+func (s Snapshot) Quantile(q float64) time.Duration {
+	if s.Count == 0 || len(s.bounds) == 0 {
+		return 0
+	}
+
+	rank := q * float64(s.Count)
+	var cum uint64
+	for i, c := range s.counts {
+		if float64(cum+c) < rank || c == 0 {
+			cum += c
+			continue
+		}
+
+		if i == len(s.bounds) {
+			return fromMillis(s.bounds[len(s.bounds)-1])
+		}
+
+		lower := 0.0
+		if i > 0 {
+			lower = s.bounds[i-1]
+		}
+
+		upper := s.bounds[i]
+		return fromMillis(lower + (upper-lower)*(rank-float64(cum))/float64(c))
+	}
+
+	return fromMillis(s.bounds[len(s.bounds)-1])
+}
+
+// Counts returns the observations per bucket, in the order of the bounds,
+// the last one counting those beyond the last bound.
+func (s Snapshot) Counts() []uint64 {
+	return append([]uint64(nil), s.counts...)
+}
+
+// MergeSnapshots adds up snapshots of the same bucket layout, like those
+// of multiple label sets of a RollingSet, in to one.
+func MergeSnapshots(snaps ...Snapshot) Snapshot {
+	var out Snapshot
+	var sum time.Duration
+	for _, s := range snaps {
+		if out.counts == nil {
+			out.bounds = s.bounds
+			out.counts = make([]uint64, len(s.counts))
+		}
+
+		if s.Window > out.Window {
+			out.Window = s.Window
+		}
+
+		for i := 0; i < len(s.counts) && i < len(out.counts); i++ {
+			out.counts[i] += s.counts[i]
+		}
+
+		out.Count += s.Count
+		out.Errors += s.Errors
+		sum += s.Mean * time.Duration(s.Count)
+	}
+
+	return out.summarize(sum)
+}
+
+// summarize fills in the derived fields once the counts are in.
+func (s Snapshot) summarize(sum time.Duration) Snapshot {
+	if s.Count == 0 {
+		return s
+	}
+
+	s.Rate = float64(s.Count) / s.Window.Seconds()
+	s.ErrorRatio = float64(s.Errors) / float64(s.Count)
+	s.Mean = sum / time.Duration(s.Count)
+	s.P50 = s.Quantile(0.50)
+	s.P95 = s.Quantile(0.95)
+	s.P99 = s.Quantile(0.99)
+	return s
+}
+
+func fromMillis(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+type rollingSlot struct {
+	epoch  int64
+	counts []uint64
+	errors uint64
+	sum    time.Duration
+}
+
+// RollingHistogram keeps bucketed counts of durations in a ring of slots,
+// Resolution wide each, so that a Snapshot over "the last minute" can be
+// computed in-process, without having to scrape and query prometheus.
+type RollingHistogram struct {
+	mu         sync.Mutex
+	bounds     []float64
+	resolution time.Duration
+	slots      []rollingSlot
+	last       int64 // epoch of the latest observation.
+}
+
+// NewRollingHistogram accepts the bucket layout in milliseconds, like
+// LatencyBins, and keeps span worth of slots, resolution wide each.
+func NewRollingHistogram(
+	ms []float64, resolution, span time.Duration,
+) *RollingHistogram {
+	if resolution <= 0 {
+		resolution = DefaultRollingResolution
+	}
+
+	if span < resolution {
+		span = DefaultRollingSpan
+	}
+
+	n := int(math.Ceil(float64(span) / float64(resolution)))
+	h := &RollingHistogram{
+		bounds:     ms,
+		resolution: resolution,
+		slots:      make([]rollingSlot, n),
+	}
+
+	for i := range h.slots {
+		h.slots[i].epoch = -1
+		h.slots[i].counts = make([]uint64, len(ms)+1)
+	}
+
+	return h
+}
+
+func (h *RollingHistogram) epoch(t time.Time) int64 {
+	return t.UnixNano() / int64(h.resolution)
+}
+
+// Observe records a duration, and whether the operation failed, at now.
+func (h *RollingHistogram) Observe(d time.Duration, failed bool) {
+	h.ObserveAt(time.Now(), d, failed)
+}
+
+// ObserveAt is Observe at a given point in time.
+func (h *RollingHistogram) ObserveAt(t time.Time, d time.Duration, failed bool) {
+	ms := float64(d) / float64(time.Millisecond)
+	b := sort.SearchFloat64s(h.bounds, ms)
+
+	e := h.epoch(t)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := &h.slots[e%int64(len(h.slots))]
+	if s.epoch != e {
+		s.epoch = e
+		s.errors = 0
+		s.sum = 0
+		for i := range s.counts {
+			s.counts[i] = 0
+		}
+	}
+
+	s.counts[b]++
+	s.sum += d
+	if failed {
+		s.errors++
+	}
+
+	if e > h.last {
+		h.last = e
+	}
+}
+
+// Snapshot summarizes the window leading up to now. A window is rounded up
+// to the resolution and capped by the span.
+func (h *RollingHistogram) Snapshot(window time.Duration) Snapshot {
+	return h.SnapshotAt(time.Now(), window)
+}
+
+// SnapshotAt is Snapshot as of a given point in time.
+func (h *RollingHistogram) SnapshotAt(t time.Time, window time.Duration) Snapshot {
+	n := int64(math.Ceil(float64(window) / float64(h.resolution)))
+	if n < 1 {
+		n = 1
+	}
+
+	if n > int64(len(h.slots)) {
+		n = int64(len(h.slots))
+	}
+
+	out := Snapshot{
+		Window: time.Duration(n) * h.resolution,
+		bounds: h.bounds,
+		counts: make([]uint64, len(h.bounds)+1),
+	}
+
+	var sum time.Duration
+	now := h.epoch(t)
+
+	h.mu.Lock()
+	for i := range h.slots {
+		s := &h.slots[i]
+		if s.epoch < 0 || s.epoch <= now-n || s.epoch > now {
+			continue
+		}
+
+		for b, c := range s.counts {
+			out.counts[b] += c
+			out.Count += c
+		}
+
+		out.Errors += s.errors
+		sum += s.sum
+	}
+	h.mu.Unlock()
+
+	return out.summarize(sum)
+}
+
+// idleSince reports whether nothing was observed since t.
+func (h *RollingHistogram) idleSince(t time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.last < h.epoch(t)
+}
+
+// LabeledSnapshot is a Snapshot of one label set of a RollingSet.
+type LabeledSnapshot struct {
+	Labels map[string]string
+	Snapshot
+}
+
+// RollingOptions describe a RollingSet. Zero values fall back to
+// LatencyBins, DefaultRollingResolution and DefaultRollingSpan.
+type RollingOptions struct {
+	Buckets    []float64 // milliseconds
+	Resolution time.Duration
+	Span       time.Duration
+
+	// Ignore lists the labels that do not split a series, like status
+	// which is what tells an error apart instead.
+	Ignore []string
+}
+
+type rollingSeries struct {
+	labels map[string]string
+	hist   *RollingHistogram
+}
+
+// RollingSet is a RollingHistogram per label set, the in-process
+// counterpart of a prometheus HistogramVec. Label sets that go quiet for
+// longer than the span are forgotten, once per resolution.
+type RollingSet struct {
+	opts   RollingOptions
+	mu     sync.RWMutex
+	series map[string]*rollingSeries
+	swept  int64 // UnixNano of the last sweep, accessed atomically.
+}
+
+// NewRollingSet returns an empty RollingSet.
+func NewRollingSet(o RollingOptions) *RollingSet {
+	if len(o.Buckets) == 0 {
+		o.Buckets = LatencyBins
+	}
+
+	if o.Resolution <= 0 {
+		o.Resolution = DefaultRollingResolution
+	}
+
+	if o.Span < o.Resolution {
+		o.Span = DefaultRollingSpan
+	}
+
+	return &RollingSet{
+		opts:   o,
+		series: map[string]*rollingSeries{},
+		swept:  time.Now().UnixNano(),
+	}
+}
+
+// key identifies a label set, sans the ignored labels.
+func (s *RollingSet) key(labels map[string]string) (string, map[string]string) {
+	kept := make(map[string]string, len(labels))
+	names := make([]string, 0, len(labels))
+	for k, v := range labels {
+		if s.ignored(k) {
+			continue
+		}
+
+		kept[k] = v
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+	var b strings.Builder
+	for _, k := range names {
+		b.WriteString(k)
+		b.WriteByte('\xff')
+		b.WriteString(kept[k])
+		b.WriteByte('\xff')
+	}
+
+	return b.String(), kept
+}
+
+func (s *RollingSet) ignored(label string) bool {
+	for _, l := range s.opts.Ignore {
+		if l == label {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Observe records a duration against the label set.
+func (s *RollingSet) Observe(
+	labels map[string]string, d time.Duration, failed bool,
+) {
+	k, kept := s.key(labels)
+
+	// the observation is written under the lock that found the series, so
+	// that a sweep cannot forget the series in between.
+	s.mu.RLock()
+	rs, ok := s.series[k]
+	if ok {
+		rs.hist.Observe(d, failed)
+	}
+	s.mu.RUnlock()
+
+	if !ok {
+		s.mu.Lock()
+		if rs, ok = s.series[k]; !ok {
+			rs = &rollingSeries{
+				labels: kept,
+				hist: NewRollingHistogram(
+					s.opts.Buckets, s.opts.Resolution, s.opts.Span,
+				),
+			}
+			s.series[k] = rs
+		}
+		rs.hist.Observe(d, failed)
+		s.mu.Unlock()
+	}
+
+	s.maybeSweep(time.Now())
+}
+
+// maybeSweep forgets the idle label sets, if a resolution went by since
+// the last sweep, so that a set that is never snapshot does not keep
+// every label set it ever saw.
+func (s *RollingSet) maybeSweep(now time.Time) {
+	last := atomic.LoadInt64(&s.swept)
+	if now.UnixNano()-last < int64(s.opts.Resolution) {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt64(&s.swept, last, now.UnixNano()) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+}
+
+// sweep forgets the label sets that went quiet for longer than the span.
+// The caller holds the write lock.
+func (s *RollingSet) sweep(now time.Time) {
+	for k, rs := range s.series {
+		if rs.hist.idleSince(now.Add(-s.opts.Span)) {
+			delete(s.series, k)
+		}
+	}
+}
+
+// Snapshot returns a LabeledSnapshot, in a stable order, for every label
+// set that was observed within the window. Label sets that went quiet for
+// longer than the span are forgotten along the way.
+func (s *RollingSet) Snapshot(window time.Duration) []LabeledSnapshot {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	keys := make([]string, 0, len(s.series))
+	for k := range s.series {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	var out []LabeledSnapshot
+	for _, k := range keys {
+		rs := s.series[k]
+		snap := rs.hist.SnapshotAt(now, window)
+		if snap.Count == 0 {
+			continue
+		}
+
+		labels := make(map[string]string, len(rs.labels))
+		for lk, lv := range rs.labels {
+			labels[lk] = lv
+		}
+
+		out = append(out, LabeledSnapshot{Labels: labels, Snapshot: snap})
+	}
+
+	return out
+}
+
+// Reset forgets every label set.
+func (s *RollingSet) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.series = map[string]*rollingSeries{}
+}
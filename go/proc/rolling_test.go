@@ -0,0 +1,111 @@
+package proc
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestRollingSetForgetsIdleSeries(t *testing.T) {
+	s := NewRollingSet(RollingOptions{
+		Resolution: 10 * time.Millisecond,
+		Span:       20 * time.Millisecond,
+	})
+
+	for _, host := range []string{"a", "b", "c"} {
+		s.Observe(map[string]string{"domain": host}, time.Millisecond, false)
+	}
+
+	assert.Equal(t, 3, len(s.series))
+
+	// without a single Snapshot, the next Observe past the span sweeps.
+	time.Sleep(50 * time.Millisecond)
+	s.Observe(map[string]string{"domain": "d"}, time.Millisecond, false)
+
+	s.mu.RLock()
+	_, ok := s.series[mustKey(s, "d")]
+	n := len(s.series)
+	s.mu.RUnlock()
+
+	assert.Equal(t, 1, n)
+	assert.Equal(t, true, ok)
+}
+
+func mustKey(s *RollingSet, domain string) string {
+	k, _ := s.key(map[string]string{"domain": domain})
+	return k
+}
+
+func TestRollingSetObserveWhileSweeping(t *testing.T) {
+	s := NewRollingSet(RollingOptions{
+		Resolution: time.Second,
+		Span:       time.Minute,
+	})
+
+	labels := map[string]string{"domain": "a"}
+	k, kept := s.key(labels)
+	for round := 0; round < 10; round++ {
+		// a series that went idle an hour ago, up for a sweep as the
+		// observations come in.
+		idle := &rollingSeries{
+			labels: kept,
+			hist: NewRollingHistogram(
+				s.opts.Buckets, s.opts.Resolution, s.opts.Span,
+			),
+		}
+		idle.hist.ObserveAt(time.Now().Add(-time.Hour), time.Millisecond, false)
+
+		s.mu.Lock()
+		s.series[k] = idle
+		s.mu.Unlock()
+
+		// the sweepers forget what went quiet before now, that is the idle
+		// series and never the one the observers keep busy, however slow
+		// they get.
+		now := time.Now()
+		const observers = 2000
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < observers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				s.Observe(labels, time.Millisecond, false)
+			}()
+		}
+
+		stop := make(chan struct{})
+		var sweepers sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			sweepers.Add(1)
+			go func() {
+				defer sweepers.Done()
+				<-start
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+
+					s.mu.Lock()
+					s.sweep(now)
+					s.mu.Unlock()
+				}
+			}()
+		}
+
+		close(start)
+		wg.Wait()
+		close(stop)
+		sweepers.Wait()
+
+		// not one of them landed on a series that was forgotten.
+		snaps := s.Snapshot(time.Minute)
+		assert.Equal(t, 1, len(snaps))
+		assert.Equal(t, uint64(observers), snaps[0].Count)
+	}
+}
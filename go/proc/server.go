@@ -1,16 +1,365 @@
 package proc
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const (
+	defaultMetricsAddr     = ":9090"
+	defaultMetricsPath     = "/metrics"
+	defaultLivenessPath    = "/healthz"
+	defaultReadinessPath   = "/readyz"
+	defaultShutdownTimeout = 5 * time.Second
+)
+
+// BasicAuth holds the credentials that a scraper must present.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// ServerOptions to be passed while creating a MetricsServer. The zero value
+// serves the default prometheus registry at :9090/metrics, over plain HTTP,
+// without any authentication.
+type ServerOptions struct {
+	// Addr is the address to listen on. Defaults to :9090
+	Addr string
+
+	// Path at which the metrics are exposed. Defaults to /metrics
+	Path string
+
+	// Gatherer whose metrics are exposed. Defaults to the
+	// prometheus.DefaultGatherer, which is where every metric of this CDK
+	// gets registered.
+	Gatherer prometheus.Gatherer
+
+	// TLSConfig, if set, is the base configuration used for serving TLS.
+	TLSConfig *tls.Config
+
+	// CertFile and KeyFile enable TLS when both are set.
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile turns TLS into mTLS, every client has to present a
+	// certificate signed by one of these CAs.
+	ClientCAFile string
+
+	// BasicAuth or BearerToken, at most one of them, protect everything
+	// but the liveness and readiness endpoints. Kubelet probes do not
+	// carry credentials, hence the exception.
+	BasicAuth   *BasicAuth
+	BearerToken string
+
+	// LivenessPath defaults to /healthz and ReadinessPath to /readyz
+	LivenessPath  string
+	ReadinessPath string
+
+	// Ready, if set, is consulted by the readiness endpoint. A non-nil
+	// error marks the process as not ready.
+	Ready func() error
+
+	// DrainDelay is how long the readiness endpoint fails, once the
+	// context is done, before the server shuts down, for the probes to
+	// notice and route traffic elsewhere. Defaults to 0, no delay.
+	DrainDelay time.Duration
+
+	// ShutdownTimeout is how long in-flight scrapes are given to finish
+	// once the context is done. Defaults to 5s
+	ShutdownTimeout time.Duration
+
+	// EnablePprof serves net/http/pprof at /debug/pprof/, EnableExpvar
+	// serves expvar at /debug/vars and EnableVersion serves the build
+	// information at /version. All of them are off by default.
+	EnablePprof   bool
+	EnableExpvar  bool
+	EnableVersion bool
+}
+
+// withDefaults fills in the blanks.
+func (o ServerOptions) withDefaults() ServerOptions {
+	if o.Addr == "" {
+		o.Addr = defaultMetricsAddr
+	}
+
+	if o.Path == "" {
+		o.Path = defaultMetricsPath
+	}
+
+	if o.Gatherer == nil {
+		o.Gatherer = prometheus.DefaultGatherer
+	}
+
+	if o.LivenessPath == "" {
+		o.LivenessPath = defaultLivenessPath
+	}
+
+	if o.ReadinessPath == "" {
+		o.ReadinessPath = defaultReadinessPath
+	}
+
+	if o.ShutdownTimeout <= 0 {
+		o.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	return o
+}
+
+// tlsConfig returns nil when TLS is not asked for.
+func (o ServerOptions) tlsConfig() (*tls.Config, error) {
+	if o.CertFile == "" && o.KeyFile == "" && o.TLSConfig == nil {
+		if o.ClientCAFile != "" {
+			return nil, errors.New("client CA requires a cert and a key")
+		}
+
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.TLSConfig != nil {
+		cfg = o.TLSConfig.Clone()
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load key pair: %w", err)
+		}
+
+		cfg.Certificates = append(cfg.Certificates, cert)
+	}
+
+	if o.ClientCAFile != "" {
+		pem, err := os.ReadFile(o.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client ca: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %v", o.ClientCAFile)
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// MetricsServer serves prometheus metrics on a ServeMux of its own, so
+// nothing that the application registers on http.DefaultServeMux leaks
+// on to the metrics port and vice-versa.
+//
+// How to use?
+// s, err := proc.NewMetricsServer(proc.ServerOptions{Addr: ":9090"})
+// ...
+// err = s.ListenAndServe(ctx) // returns once ctx is done
+type MetricsServer struct {
+	opts     ServerOptions
+	mux      *http.ServeMux
+	srv      *http.Server
+	stopping int32 // set atomically once shutdown begins.
+
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+// NewMetricsServer validates the options and returns a server that is
+// ready to ListenAndServe.
+func NewMetricsServer(o ServerOptions) (*MetricsServer, error) {
+	o = o.withDefaults()
+	if o.BasicAuth != nil && o.BearerToken != "" {
+		return nil, errors.New("use either basic auth or a bearer token")
+	}
+
+	tlsCfg, err := o.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("tls config: %w", err)
+	}
+
+	s := &MetricsServer{opts: o, mux: http.NewServeMux()}
+	s.srv = &http.Server{
+		Handler:           s.mux,
+		TLSConfig:         tlsCfg,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	s.Handle(o.Path, promhttp.HandlerFor(o.Gatherer, promhttp.HandlerOpts{}))
+	s.mux.HandleFunc(o.LivenessPath, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	s.mux.HandleFunc(o.ReadinessPath, s.serveReadiness)
+	s.registerDebug()
+
+	return s, nil
+}
+
+// Handle registers an additional handler on the metrics port. The handler
+// sits behind the same authentication as the metrics endpoint.
+func (s *MetricsServer) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, s.authenticate(h))
+}
+
+// Addr returns the address that the server is listening on. Handy when
+// the options asked for port 0.
+func (s *MetricsServer) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return s.opts.Addr
+	}
+
+	return s.listener.Addr().String()
+}
+
+// ListenAndServe binds the address and serves until the context is done,
+// after which it shuts down gracefully. Unlike http.ListenAndServe a
+// failure to bind is returned right away instead of being lost in a
+// goroutine. A graceful shutdown returns nil.
+func (s *MetricsServer) ListenAndServe(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.opts.Addr)
+	if err != nil {
+		return fmt.Errorf("listen %v: %w", s.opts.Addr, err)
+	}
+
+	s.mu.Lock()
+	s.listener = ln
+	s.mu.Unlock()
+
+	errCh := make(chan error, 1)
+	go func() {
+		if s.srv.TLSConfig != nil {
+			errCh <- s.srv.ServeTLS(ln, "", "")
+			return
+		}
+
+		errCh <- s.srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("serve: %w", err)
+	case <-ctx.Done():
+	}
+
+	// Fail the readiness probe first, and keep serving it for DrainDelay,
+	// so that nothing new gets routed here.
+	atomic.StoreInt32(&s.stopping, 1)
+	if s.opts.DrainDelay > 0 {
+		select {
+		case err := <-errCh:
+			return fmt.Errorf("serve: %w", err)
+		case <-time.After(s.opts.DrainDelay):
+		}
+	}
+
+	sctx, cancel := context.WithTimeout(
+		context.Background(), s.opts.ShutdownTimeout,
+	)
+	defer cancel()
+
+	if err := s.srv.Shutdown(sctx); err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve: %w", err)
+	}
+
+	return nil
+}
+
+func (s *MetricsServer) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.stopping) == 1 {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	if s.opts.Ready != nil {
+		if err := s.opts.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// authenticate wraps h with whichever authentication was configured.
+func (s *MetricsServer) authenticate(h http.Handler) http.Handler {
+	switch {
+	case s.opts.BasicAuth != nil:
+		ba := s.opts.BasicAuth
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, p, ok := r.BasicAuth()
+			if !ok || !secureEqual(u, ba.Username) ||
+				!secureEqual(p, ba.Password) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	case s.opts.BearerToken != "":
+		want := "Bearer " + s.opts.BearerToken
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !secureEqual(r.Header.Get("Authorization"), want) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+
+	return h
+}
+
+// secureEqual compares in constant time to not leak credentials via timing.
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
 // ServeMetrics exposes whatever prometheus metrics are, on specified Port
+// It blocks for as long as the server runs. Use NewMetricsServer instead
+// for graceful shutdown, TLS or authentication.
 func ServeMetrics(port int) {
-	log.Println("Serving metrics on", port)
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	ServeMetricsWithOptions(ServerOptions{Addr: fmt.Sprintf(":%d", port)})
+}
+
+// ServeMetricsWithOptions is ServeMetrics for when the same port should
+// also serve the debug endpoints.
+// How to use?
+// go proc.ServeMetricsWithOptions(proc.ServerOptions{EnablePprof: true})
+func ServeMetricsWithOptions(o ServerOptions) {
+	log.Println("Serving metrics on", o.withDefaults().Addr)
+	s, err := NewMetricsServer(o)
+	if err != nil {
+		log.Printf("%+v", err)
+		return
+	}
+
+	if err := s.ListenAndServe(context.Background()); err != nil {
+		log.Printf("%+v", err)
+	}
 }
@@ -0,0 +1,201 @@
+package proc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+// get requests path from s, through its mux, with the auth that set sets.
+func get(s *MetricsServer, path string, set func(*http.Request)) int {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if set != nil {
+		set(r)
+	}
+
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	return w.Code
+}
+
+func newTestServer(t *testing.T, o ServerOptions) *MetricsServer {
+	t.Helper()
+
+	if o.Gatherer == nil {
+		o.Gatherer = prometheus.NewRegistry()
+	}
+
+	s, err := NewMetricsServer(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestMetricsServerAuth(t *testing.T) {
+	basic := func(u, p string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(u, p) }
+	}
+
+	bearer := func(tok string) func(*http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+tok)
+		}
+	}
+
+	t.Run("basic auth", func(t *testing.T) {
+		s := newTestServer(t, ServerOptions{
+			BasicAuth: &BasicAuth{Username: "prom", Password: "secret"},
+		})
+
+		assert.Equal(t, http.StatusUnauthorized, get(s, "/metrics", nil))
+		assert.Equal(t, http.StatusUnauthorized,
+			get(s, "/metrics", basic("prom", "wrong")))
+		assert.Equal(t, http.StatusOK, get(s, "/metrics", basic("prom", "secret")))
+
+		// probes carry no credentials.
+		assert.Equal(t, http.StatusOK, get(s, "/healthz", nil))
+		assert.Equal(t, http.StatusOK, get(s, "/readyz", nil))
+	})
+
+	t.Run("bearer token", func(t *testing.T) {
+		s := newTestServer(t, ServerOptions{BearerToken: "token"})
+
+		assert.Equal(t, http.StatusUnauthorized, get(s, "/metrics", nil))
+		assert.Equal(t, http.StatusUnauthorized,
+			get(s, "/metrics", bearer("other")))
+		assert.Equal(t, http.StatusOK, get(s, "/metrics", bearer("token")))
+		assert.Equal(t, http.StatusOK, get(s, "/healthz", nil))
+		assert.Equal(t, http.StatusOK, get(s, "/readyz", nil))
+	})
+
+	t.Run("no auth", func(t *testing.T) {
+		s := newTestServer(t, ServerOptions{})
+		assert.Equal(t, http.StatusOK, get(s, "/metrics", nil))
+	})
+
+	t.Run("both", func(t *testing.T) {
+		_, err := NewMetricsServer(ServerOptions{
+			BasicAuth: &BasicAuth{}, BearerToken: "token",
+		})
+		assert.NotEqual(t, nil, err)
+	})
+}
+
+func TestMetricsServerReadiness(t *testing.T) {
+	var notReady error
+	s := newTestServer(t, ServerOptions{Ready: func() error { return notReady }})
+	assert.Equal(t, http.StatusOK, get(s, "/readyz", nil))
+
+	notReady = errors.New("warming up")
+	assert.Equal(t, http.StatusServiceUnavailable, get(s, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, get(s, "/healthz", nil))
+}
+
+func TestMetricsServerTLSConfig(t *testing.T) {
+	_, err := NewMetricsServer(ServerOptions{ClientCAFile: "ca.pem"})
+	assert.NotEqual(t, nil, err)
+
+	_, err = NewMetricsServer(ServerOptions{
+		CertFile: "missing.pem", KeyFile: "missing.key",
+	})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestMetricsServerListenAndServe(t *testing.T) {
+	t.Run("bind error", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		s := newTestServer(t, ServerOptions{Addr: ln.Addr().String()})
+
+		// returns right away, without the context being done.
+		err = s.ListenAndServe(context.Background())
+		assert.NotEqual(t, nil, err)
+		assert.Equal(t, true, strings.HasPrefix(err.Error(), "listen "))
+	})
+
+	t.Run("drain delay", func(t *testing.T) {
+		s := newTestServer(t, ServerOptions{
+			Addr: "127.0.0.1:0", DrainDelay: 200 * time.Millisecond,
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- s.ListenAndServe(ctx) }()
+
+		url := waitForAddr(t, s)
+		cancel()
+
+		// the probe fails over the network, while the server drains.
+		time.Sleep(50 * time.Millisecond)
+		res, err := http.Get(url + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+
+		select {
+		case err := <-done:
+			assert.Equal(t, nil, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("ListenAndServe did not return after the drain delay")
+		}
+	})
+
+	t.Run("graceful shutdown", func(t *testing.T) {
+		s := newTestServer(t, ServerOptions{Addr: "127.0.0.1:0"})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- s.ListenAndServe(ctx) }()
+
+		url := waitForAddr(t, s)
+		res, err := http.Get(url + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		cancel()
+		select {
+		case err := <-done:
+			assert.Equal(t, nil, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("ListenAndServe did not return after the context was done")
+		}
+
+		// readiness fails once the shutdown begins.
+		assert.Equal(t, http.StatusServiceUnavailable, get(s, "/readyz", nil))
+	})
+}
+
+// waitForAddr waits for the listener, which Addr reports once bound, and
+// returns the URL of the server.
+func waitForAddr(t *testing.T, s *MetricsServer) string {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		if a := s.Addr(); a != "127.0.0.1:0" {
+			return "http://" + a
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("the server did not start listening")
+	return ""
+}
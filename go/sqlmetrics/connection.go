@@ -1,6 +1,7 @@
 package sqlmetrics
 
 import (
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -14,7 +15,13 @@ type connInfo struct {
 	dsn       string
 	dbName    string
 	dbHost    string
-	createdAt int
+	createdAt time.Time
+
+	// system is the driver that dburl resolved the DSN to, like postgres,
+	// and address and port the server's, for the spans.
+	system  string
+	address string
+	port    int
 }
 
 func (c *connInfo) LabelSet() LabelSet {
@@ -32,14 +39,23 @@ var (
 	connMap sync.Map
 )
 
-func storeConnInfo(conn *proxy.Conn, dsn string) error {
+// storeConnInfo keeps the info of a connection until deleteConnInfo. A
+// DSN that does not parse still keeps when the connection was created,
+// though without the labels.
+func storeConnInfo(conn *proxy.Conn, dsn string) (*connInfo, error) {
 	info, err := parseDSN(dsn)
 	if err != nil {
-		return errors.Wrap(err, "parse dsn")
+		info = &connInfo{createdAt: time.Now()}
+		err = errors.Wrap(err, "parse dsn")
 	}
 
 	connMap.Store(conn, info)
-	return nil
+	return info, err
+}
+
+// deleteConnInfo forgets a connection that was closed.
+func deleteConnInfo(conn *proxy.Conn) {
+	connMap.Delete(conn)
 }
 
 func loadConnInfo(conn *proxy.Conn) *connInfo {
@@ -69,10 +85,14 @@ func parseDSN(dsn string) (*connInfo, error) {
 		dbHost = "localhost"
 	}
 
+	port, _ := strconv.Atoi(u.URL.Port())
 	return &connInfo{
 		dsn:       dsn,
 		dbName:    dbName,
 		dbHost:    dbHost,
-		createdAt: int(time.Now().Unix()),
+		createdAt: time.Now(),
+		system:    u.Driver,
+		address:   u.URL.Hostname(),
+		port:      port,
 	}, nil
 }
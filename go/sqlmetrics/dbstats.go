@@ -2,98 +2,141 @@ package sqlmetrics
 
 import (
 	"database/sql"
-	"time"
 
 	"github.com/last9/last9-cdk/go/proc"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-var (
-	dbLabels = []string{
-		proc.LabelHostname, "dbname", "dbhost",
-		proc.LabelProgram, proc.LabelTenant, proc.LabelCluster,
+var dbLabels = []string{
+	proc.LabelHostname, "dbname", "dbhost",
+	proc.LabelProgram, proc.LabelTenant, proc.LabelCluster,
+}
+
+// dbStat is a field of sql.DBStats, as a metric.
+type dbStat struct {
+	name  string
+	help  string
+	kind  prometheus.ValueType
+	value func(sql.DBStats) float64
+}
+
+// dbStats are every field of sql.DBStats. The counters of DBStats are
+// cumulative already, so they are exposed as they are. The wait duration
+// is in seconds, and named so, as connections_wait_duration_total used
+// to be in nanoseconds.
+var dbStats = []dbStat{
+	{
+		"connections_max_open",
+		"Maximum number of open connections to the database.",
+		prometheus.GaugeValue,
+		func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) },
+	},
+	{
+		"connections_open",
+		"The number of established connections, both in use and idle.",
+		prometheus.GaugeValue,
+		func(s sql.DBStats) float64 { return float64(s.OpenConnections) },
+	},
+	{
+		"connections_in_use",
+		"The number of connections currently in use.",
+		prometheus.GaugeValue,
+		func(s sql.DBStats) float64 { return float64(s.InUse) },
+	},
+	{
+		"connections_idle",
+		"The number of idle connections.",
+		prometheus.GaugeValue,
+		func(s sql.DBStats) float64 { return float64(s.Idle) },
+	},
+	{
+		"connections_wait_total",
+		"The total number of connections waited for.",
+		prometheus.CounterValue,
+		func(s sql.DBStats) float64 { return float64(s.WaitCount) },
+	},
+	{
+		"connections_wait_duration_seconds_total",
+		"The total time blocked waiting for a new connection, in seconds.",
+		prometheus.CounterValue,
+		func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() },
+	},
+	{
+		"connections_max_idle_closed_total",
+		"The total number of connections closed due to SetMaxIdleConns.",
+		prometheus.CounterValue,
+		func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) },
+	},
+	{
+		"connections_max_idle_time_closed_total",
+		"The total number of connections closed due to SetConnMaxIdleTime.",
+		prometheus.CounterValue,
+		func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) },
+	},
+	{
+		"connections_max_lifetime_closed_total",
+		"The total number of connections closed due to SetConnMaxLifetime.",
+		prometheus.CounterValue,
+		func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) },
+	},
+}
+
+// DBStatsCollector is a prometheus.Collector of the sql.DBStats of a DB,
+// read as it is scraped. Unregister it once the DB is closed.
+// How to use?
+// c, err := sqlmetrics.NewDBStatsCollector("primary", db, dsn)
+// prometheus.MustRegister(c)
+// defer prometheus.Unregister(c)
+type DBStatsCollector struct {
+	db     *sql.DB
+	descs  []*prometheus.Desc // of dbStats
+	values []string           // of dbLabels
+}
+
+// NewDBStatsCollector returns a DBStatsCollector of db, labeled with
+// name, to tell it apart from the other DBs of the program, and with the
+// dbname and dbhost of its dsn.
+func NewDBStatsCollector(
+	name string, db *sql.DB, dsn string,
+) (*DBStatsCollector, error) {
+	l, err := makeStatsLabels(dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "stats labels")
 	}
 
-	maxOpenConnections = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: prometheus.BuildFQName(
-				proc.Namespace,
-				subsystem,
-				"connections_max_open",
-			),
-			Help: "Maximum number of open connections to the database.",
-		},
-		dbLabels,
-	)
-
-	connectionsInUse = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: prometheus.BuildFQName(
-				proc.Namespace,
-				subsystem,
-				"connections_in_use",
-			),
-			Help: "The number of connections currently in use.",
-		},
-		dbLabels,
-	)
-
-	connectionsIdle = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: prometheus.BuildFQName(
-				proc.Namespace,
-				subsystem,
-				"connections_idle",
-			),
-			Help: "The number of idle connections.",
-		},
-		dbLabels,
-	)
-
-	// WaitCount is a counter of total no. of connections waited for.
-	waitCount = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: prometheus.BuildFQName(
-				proc.Namespace,
-				subsystem,
-				"connections_wait_total",
-			),
-			Help: "The total number of connections waited for",
-		},
-		dbLabels,
-	)
-
-	waitDuration = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: prometheus.BuildFQName(
-				proc.Namespace,
-				subsystem,
-				"connections_wait_duration_total",
-			),
-			Help: "The total time blocked waiting for a new connection.",
-		},
-		dbLabels,
-	)
-)
+	c := &DBStatsCollector{db: db}
+	for _, k := range dbLabels {
+		c.values = append(c.values, l[k])
+	}
+
+	// name is a constant label, for the collectors of two DBs to differ
+	// in their descriptions.
+	for _, s := range dbStats {
+		c.descs = append(c.descs, prometheus.NewDesc(
+			prometheus.BuildFQName(proc.Namespace, subsystem, s.name),
+			s.help, dbLabels, prometheus.Labels{"name": name},
+		))
+	}
 
-func init() {
-	prometheus.MustRegister(maxOpenConnections)
-	prometheus.MustRegister(connectionsInUse)
-	prometheus.MustRegister(connectionsIdle)
-	prometheus.MustRegister(waitCount)
-	prometheus.MustRegister(waitDuration)
+	return c, nil
+}
+
+// Describe implements prometheus.Collector
+func (c *DBStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
 }
 
-// emitStats accepts a DBStats struct and sets or increments all the
-// appropriate metrics.
-func emitStats(s sql.DBStats, labels LabelSet) {
-	ls := labels.ToMap()
-	maxOpenConnections.With(ls).Set(float64(s.MaxOpenConnections))
-	connectionsInUse.With(ls).Set(float64(s.InUse))
-	connectionsIdle.With(ls).Set(float64(s.Idle))
-	waitCount.With(ls).Add(float64(s.WaitCount))
-	waitDuration.With(ls).Add(float64(s.WaitDuration))
+// Collect implements prometheus.Collector
+func (c *DBStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	st := c.db.Stats()
+	for i, s := range dbStats {
+		ch <- prometheus.MustNewConstMetric(
+			c.descs[i], s.kind, s.value(st), c.values...,
+		)
+	}
 }
 
 // make Labels to be used for DB Stats
@@ -103,6 +146,11 @@ func makeStatsLabels(dsn string) (LabelSet, error) {
 		return nil, errors.Wrap(err, "parse dsn emit db")
 	}
 
+	return dbLabelSet(info), nil
+}
+
+// dbLabelSet returns every one of the dbLabels, of a connection.
+func dbLabelSet(info *connInfo) LabelSet {
 	labels := LabelSet{}
 	for _, k := range dbLabels {
 		labels[k] = ""
@@ -110,23 +158,23 @@ func makeStatsLabels(dsn string) (LabelSet, error) {
 
 	labels[proc.LabelProgram] = proc.GetProgamName()
 	labels[proc.LabelHostname] = proc.GetHostname()
-	return labels.Merge(info.LabelSet()), nil
+	return labels.Merge(info.LabelSet())
 }
 
-// EmitDBStats accepts a Database connection and starts a per-minute tick
-// to emit the gauges and counters corresponding the connections spawned
-// by this binary. It's fairly light weight with minimal allocation so
-// performance should not really be a concern here.
+// EmitDBStats registers a DBStatsCollector of db, named after the dbname
+// of the dsn, with the default registry. It no longer blocks.
+//
+// Deprecated: Use NewDBStatsCollector, which can be unregistered.
 func EmitDBStats(db *sql.DB, dsn string) error {
-	l, err := makeStatsLabels(dsn)
+	info, err := parseDSN(dsn)
 	if err != nil {
-		return errors.Wrap(err, "stats labels")
+		return errors.Wrap(err, "parse dsn emit db")
 	}
 
-	ticker := time.NewTicker(60 * time.Second)
-	for range ticker.C {
-		emitStats(db.Stats(), l)
+	c, err := NewDBStatsCollector(info.dbName, db, dsn)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return errors.Wrap(prometheus.Register(c), "register db stats")
 }
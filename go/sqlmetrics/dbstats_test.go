@@ -0,0 +1,81 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gotest.tools/assert"
+)
+
+func TestDBStatsCollector(t *testing.T) {
+	ctx := context.Background()
+
+	primary := openFake(t, Options{}, defaultLabelMaker)
+	primary.SetMaxOpenConns(4)
+
+	// through the same proxy.
+	replica, err := sql.Open(fakeDriverName+":"+t.Name(), fakeDSN)
+	assert.NilError(t, err)
+	defer replica.Close()
+
+	conn, err := primary.Conn(ctx)
+	assert.NilError(t, err)
+	defer conn.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	p, err := NewDBStatsCollector("primary", primary, fakeDSN)
+	assert.NilError(t, err)
+	r, err := NewDBStatsCollector("replica", replica, fakeDSN)
+	assert.NilError(t, err)
+	reg.MustRegister(p, r)
+
+	_, err = NewDBStatsCollector("broken", primary, "::")
+	assert.ErrorContains(t, err, "stats labels")
+
+	values := func() map[string]map[string]float64 {
+		mfs, err := reg.Gather()
+		assert.NilError(t, err)
+
+		out := map[string]map[string]float64{}
+		for _, mf := range mfs {
+			out[mf.GetName()] = map[string]float64{}
+			for _, m := range mf.GetMetric() {
+				var name string
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "name" {
+						name = l.GetValue()
+					}
+				}
+
+				v := m.GetGauge().GetValue() + m.GetCounter().GetValue()
+				out[mf.GetName()][name] = v
+			}
+		}
+
+		return out
+	}
+
+	v := values()
+	assert.Equal(t, 9, len(v))
+	assert.Equal(t, 4.0, v["last9_sql_connections_max_open"]["primary"])
+	assert.Equal(t, 0.0, v["last9_sql_connections_max_open"]["replica"])
+	assert.Equal(t, 1.0, v["last9_sql_connections_in_use"]["primary"])
+	assert.Equal(t, 1.0, v["last9_sql_connections_open"]["primary"])
+
+	// read at every scrape, not added up.
+	assert.NilError(t, conn.Close())
+	v = values()
+	assert.Equal(t, 0.0, v["last9_sql_connections_in_use"]["primary"])
+	assert.Equal(t, 1.0, v["last9_sql_connections_idle"]["primary"])
+	assert.Equal(t, 0.0, v["last9_sql_connections_wait_total"]["primary"])
+
+	_, ok := v["last9_sql_connections_wait_duration_seconds_total"]["primary"]
+	assert.Assert(t, ok)
+	_, ok = v["last9_sql_connections_wait_duration_total"]
+	assert.Assert(t, !ok)
+
+	assert.Assert(t, reg.Unregister(r))
+	assert.Equal(t, 1, len(values()["last9_sql_connections_idle"]))
+}
@@ -0,0 +1,259 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// The error_class label of a failed statement.
+const (
+	ErrorClassUniqueViolation      = "unique_violation"
+	ErrorClassForeignKeyViolation  = "foreign_key_violation"
+	ErrorClassNotNullViolation     = "not_null_violation"
+	ErrorClassCheckViolation       = "check_violation"
+	ErrorClassDeadlock             = "deadlock"
+	ErrorClassSerialization        = "serialization_failure"
+	ErrorClassLockTimeout          = "lock_timeout"
+	ErrorClassTimeout              = "timeout"
+	ErrorClassCanceled             = "canceled"
+	ErrorClassConnection           = "connection"
+	ErrorClassSyntax               = "syntax"
+	ErrorClassUndefined            = "undefined_object"
+	ErrorClassPermission           = "permission"
+	ErrorClassData                 = "data_exception"
+	ErrorClassInsufficientResource = "insufficient_resources"
+	ErrorClassOther                = "other"
+)
+
+// ErrorClassifier maps the error of a statement to its error_class.
+type ErrorClassifier func(error) string
+
+// ClassifyError is the default ErrorClassifier. It knows of the context's
+// and database/sql's errors, network errors, SQLSTATE codes from lib/pq
+// and any error with a SQLState() method, like pgx's, MySQL error numbers
+// and SQLite result codes. The MySQL and SQLite errors are recognized by
+// their shape, the Number of go-sql-driver/mysql's MySQLError, the Code
+// and ExtendedCode of mattn/go-sqlite3's Error and the Code() of
+// modernc.org/sqlite's, so that this package does not import every
+// driver.
+func ClassifyError(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCanceled
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorClassConnection
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return classifySQLState(string(pqErr.Code))
+	}
+
+	var stater interface{ SQLState() string }
+	if errors.As(err, &stater) {
+		return classifySQLState(stater.SQLState())
+	}
+
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if c, ok := classifyByShape(e); ok {
+			return c
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrorClassTimeout
+		}
+		return ErrorClassConnection
+	}
+
+	return ErrorClassOther
+}
+
+// classifySQLState maps a SQLSTATE, by its code and else by its class,
+// the first two characters.
+func classifySQLState(code string) string {
+	switch code {
+	case "23505":
+		return ErrorClassUniqueViolation
+	case "23503":
+		return ErrorClassForeignKeyViolation
+	case "23502":
+		return ErrorClassNotNullViolation
+	case "23514":
+		return ErrorClassCheckViolation
+	case "40P01":
+		return ErrorClassDeadlock
+	case "40001":
+		return ErrorClassSerialization
+	case "55P03":
+		return ErrorClassLockTimeout
+	case "57014":
+		// query_canceled, which statement_timeout raises too.
+		return ErrorClassTimeout
+	case "57P01", "57P02", "57P03":
+		return ErrorClassConnection
+	case "42601":
+		return ErrorClassSyntax
+	case "42501":
+		return ErrorClassPermission
+	}
+
+	if len(code) < 2 {
+		return ErrorClassOther
+	}
+
+	switch code[:2] {
+	case "08":
+		return ErrorClassConnection
+	case "22":
+		return ErrorClassData
+	case "28":
+		return ErrorClassPermission
+	case "40":
+		return ErrorClassSerialization
+	case "42":
+		return ErrorClassUndefined
+	case "53":
+		return ErrorClassInsufficientResource
+	}
+
+	return ErrorClassOther
+}
+
+// mysqlErrors maps the MySQL server's and client's error numbers.
+var mysqlErrors = map[uint64]string{
+	1062: ErrorClassUniqueViolation,      // ER_DUP_ENTRY
+	1586: ErrorClassUniqueViolation,      // ER_DUP_ENTRY_WITH_KEY_NAME
+	1451: ErrorClassForeignKeyViolation,  // ER_ROW_IS_REFERENCED_2
+	1452: ErrorClassForeignKeyViolation,  // ER_NO_REFERENCED_ROW_2
+	1048: ErrorClassNotNullViolation,     // ER_BAD_NULL_ERROR
+	3819: ErrorClassCheckViolation,       // ER_CHECK_CONSTRAINT_VIOLATED
+	1213: ErrorClassDeadlock,             // ER_LOCK_DEADLOCK
+	1205: ErrorClassLockTimeout,          // ER_LOCK_WAIT_TIMEOUT
+	3024: ErrorClassTimeout,              // ER_QUERY_TIMEOUT
+	1317: ErrorClassCanceled,             // ER_QUERY_INTERRUPTED
+	1040: ErrorClassConnection,           // ER_CON_COUNT_ERROR
+	1053: ErrorClassConnection,           // ER_SERVER_SHUTDOWN
+	2002: ErrorClassConnection,           // CR_CONNECTION_ERROR
+	2003: ErrorClassConnection,           // CR_CONN_HOST_ERROR
+	2006: ErrorClassConnection,           // CR_SERVER_GONE_ERROR
+	2013: ErrorClassConnection,           // CR_SERVER_LOST
+	1064: ErrorClassSyntax,               // ER_PARSE_ERROR
+	1146: ErrorClassUndefined,            // ER_NO_SUCH_TABLE
+	1054: ErrorClassUndefined,            // ER_BAD_FIELD_ERROR
+	1044: ErrorClassPermission,           // ER_DBACCESS_DENIED_ERROR
+	1045: ErrorClassPermission,           // ER_ACCESS_DENIED_ERROR
+	1142: ErrorClassPermission,           // ER_TABLEACCESS_DENIED_ERROR
+	1264: ErrorClassData,                 // ER_WARN_DATA_OUT_OF_RANGE
+	1366: ErrorClassData,                 // ER_TRUNCATED_WRONG_VALUE_FOR_FIELD
+	1406: ErrorClassData,                 // ER_DATA_TOO_LONG
+	1114: ErrorClassInsufficientResource, // ER_RECORD_FILE_FULL
+}
+
+// sqliteErrors maps SQLite's extended result codes, and else the primary
+// ones, its low 8 bits.
+var sqliteErrors = map[int64]string{
+	2067: ErrorClassUniqueViolation,      // SQLITE_CONSTRAINT_UNIQUE
+	1555: ErrorClassUniqueViolation,      // SQLITE_CONSTRAINT_PRIMARYKEY
+	787:  ErrorClassForeignKeyViolation,  // SQLITE_CONSTRAINT_FOREIGNKEY
+	1299: ErrorClassNotNullViolation,     // SQLITE_CONSTRAINT_NOTNULL
+	275:  ErrorClassCheckViolation,       // SQLITE_CONSTRAINT_CHECK
+	5:    ErrorClassLockTimeout,          // SQLITE_BUSY
+	6:    ErrorClassLockTimeout,          // SQLITE_LOCKED
+	9:    ErrorClassCanceled,             // SQLITE_INTERRUPT
+	13:   ErrorClassInsufficientResource, // SQLITE_FULL
+	3:    ErrorClassPermission,           // SQLITE_PERM
+	23:   ErrorClassPermission,           // SQLITE_AUTH
+	14:   ErrorClassConnection,           // SQLITE_CANTOPEN
+	18:   ErrorClassData,                 // SQLITE_TOOBIG
+	20:   ErrorClassData,                 // SQLITE_MISMATCH
+}
+
+// classifyByShape classifies the MySQL and SQLite errors by their type's
+// name, fields or methods.
+func classifyByShape(err error) (string, bool) {
+	v := reflect.ValueOf(err)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return "", false
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return "", false
+	}
+
+	// go-sql-driver/mysql
+	if v.Type().Name() == "MySQLError" {
+		if n, ok := uintField(v, "Number"); ok {
+			if c, ok := mysqlErrors[n]; ok {
+				return c, true
+			}
+			return ErrorClassOther, true
+		}
+	}
+
+	// mattn/go-sqlite3
+	if code, ok := intField(v, "ExtendedCode"); ok {
+		if _, ok := intField(v, "Code"); ok {
+			return classifySQLite(code), true
+		}
+	}
+
+	// modernc.org/sqlite
+	if strings.HasSuffix(v.Type().PkgPath(), "modernc.org/sqlite") {
+		if coder, ok := err.(interface{ Code() int }); ok {
+			return classifySQLite(int64(coder.Code())), true
+		}
+	}
+
+	return "", false
+}
+
+func classifySQLite(code int64) string {
+	if c, ok := sqliteErrors[code]; ok {
+		return c
+	}
+
+	if c, ok := sqliteErrors[code&0xff]; ok {
+		return c
+	}
+
+	return ErrorClassOther
+}
+
+func uintField(v reflect.Value, name string) (uint64, bool) {
+	f := v.FieldByName(name)
+	switch f.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return f.Uint(), true
+	}
+
+	return 0, false
+}
+
+func intField(v reflect.Value, name string) (int64, bool) {
+	f := v.FieldByName(name)
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return f.Int(), true
+	}
+
+	return 0, false
+}
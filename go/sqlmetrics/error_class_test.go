@@ -0,0 +1,107 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+)
+
+// MySQLError and sqlite3Error have the shape of the errors of
+// go-sql-driver/mysql and mattn/go-sqlite3.
+type MySQLError struct {
+	Number   uint16
+	SQLState [5]byte
+	Message  string
+}
+
+func (e *MySQLError) Error() string { return e.Message }
+
+type sqlite3Error struct {
+	Code         int
+	ExtendedCode int
+}
+
+func (e sqlite3Error) Error() string { return "sqlite" }
+
+type pgxError struct{ code string }
+
+func (e *pgxError) Error() string    { return "pgx" }
+func (e *pgxError) SQLState() string { return e.code }
+
+func TestClassifyError(t *testing.T) {
+	for err, expected := range map[error]string{
+		nil:                      "",
+		context.DeadlineExceeded: ErrorClassTimeout,
+		context.Canceled:         ErrorClassCanceled,
+		fmt.Errorf("exec: %w", driver.ErrBadConn):            ErrorClassConnection,
+		&pq.Error{Code: "23505"}:                             ErrorClassUniqueViolation,
+		&pq.Error{Code: "40P01"}:                             ErrorClassDeadlock,
+		&pq.Error{Code: "08006"}:                             ErrorClassConnection,
+		&pq.Error{Code: "42P01"}:                             ErrorClassUndefined,
+		&pgxError{"40001"}:                                   ErrorClassSerialization,
+		&pgxError{"23503"}:                                   ErrorClassForeignKeyViolation,
+		&MySQLError{Number: 1062}:                            ErrorClassUniqueViolation,
+		&MySQLError{Number: 1213}:                            ErrorClassDeadlock,
+		&MySQLError{Number: 9999}:                            ErrorClassOther,
+		fmt.Errorf("wrapped: %w", &MySQLError{Number: 1205}): ErrorClassLockTimeout,
+		sqlite3Error{Code: 19, ExtendedCode: 2067}:           ErrorClassUniqueViolation,
+		sqlite3Error{Code: 5, ExtendedCode: 261}:             ErrorClassLockTimeout,
+		errors.New("boom"):                                   ErrorClassOther,
+	} {
+		assert.Equal(t, expected, ClassifyError(err), "%v", err)
+	}
+}
+
+func TestErrorClassLabel(t *testing.T) {
+	resetMetrics()
+	EnableSnapshots()
+
+	db := openFake(t, Options{
+		ErrorClassifier: func(err error) string { return "custom" },
+	}, func(q string) LabelSet {
+		return LabelSet{"per": q[:6]}
+	})
+
+	_, err := db.Exec("UPDATE fail")
+	assert.ErrorContains(t, err, errFake.Error())
+	_, err = db.Exec("UPDATE t")
+	assert.NilError(t, err)
+
+	// two series, of one window.
+	assert.Equal(t, 2, testutil.CollectAndCount(
+		sqlQueryDuration, "last9_sql_query_duration_milliseconds",
+	))
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	assert.NilError(t, err)
+
+	var failed, succeeded bool
+	for _, mf := range mfs {
+		if mf.GetName() != "last9_sql_query_duration_milliseconds" {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			failed = failed || labelSetContains(m.GetLabel(), map[string]string{
+				"status": "failure", "error_class": "custom",
+			})
+			succeeded = succeeded || labelSetContains(m.GetLabel(), map[string]string{
+				"status": "success", "error_class": "",
+			})
+		}
+	}
+	assert.Assert(t, failed)
+	assert.Assert(t, succeeded)
+
+	snaps := Snapshot(time.Minute)
+	assert.Equal(t, 1, len(snaps))
+	assert.Equal(t, uint64(1), snaps[0].Errors)
+}
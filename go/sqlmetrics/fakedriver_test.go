@@ -0,0 +1,185 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDriver is a database/sql driver that needs no database, for the
+// tests that do not care about what the database does. A query that has
+// "fail" in it fails and every other one returns fakeRowCount rows of a
+// single column "n". One that has "unpreparable" in it fails to prepare
+// and one that has "skip" in it is not run ad-hoc, driver.ErrSkip, as
+// MySQL does with the statements that have arguments.
+// A transaction that ran a "poison" statement fails to commit. A DSN with
+// "refused" in it fails to connect.
+type fakeDriver struct{}
+
+const (
+	fakeDriverName = "fakedb"
+	fakeDSN        = "postgres://fake@db.internal:5432/app?sslmode=disable"
+	fakeRowCount   = 3
+)
+
+var errFake = errors.New("fake failure")
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	if strings.Contains(dsn, "refused") {
+		return nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	}
+
+	return &fakeConn{}, nil
+}
+
+type fakeConn struct{ poisoned bool }
+
+func (c *fakeConn) Prepare(q string) (driver.Stmt, error) {
+	if strings.Contains(q, "unpreparable") {
+		return nil, errFake
+	}
+
+	if strings.Contains(q, "poison") {
+		c.poisoned = true
+	}
+
+	return &fakeStmt{q: q}, nil
+}
+
+// ExecContext and QueryContext run a statement without preparing it, as
+// most drivers do.
+func (c *fakeConn) ExecContext(
+	ctx context.Context, q string, args []driver.NamedValue,
+) (driver.Result, error) {
+	if strings.Contains(q, "skip") {
+		return nil, driver.ErrSkip
+	}
+
+	stmt, _ := c.Prepare(q)
+	return stmt.Exec(nil)
+}
+
+func (c *fakeConn) QueryContext(
+	ctx context.Context, q string, args []driver.NamedValue,
+) (driver.Rows, error) {
+	if strings.Contains(q, "skip") {
+		return nil, driver.ErrSkip
+	}
+
+	stmt, _ := c.Prepare(q)
+	return stmt.Query(nil)
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{c}, nil }
+
+type fakeTx struct{ c *fakeConn }
+
+func (tx fakeTx) Commit() error {
+	if tx.c.poisoned {
+		tx.c.poisoned = false
+		return errFake
+	}
+
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.c.poisoned = false
+	return nil
+}
+
+type fakeStmt struct{ q string }
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if strings.Contains(s.q, "fail") {
+		return nil, errFake
+	}
+
+	return driver.RowsAffected(fakeRowCount), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if strings.Contains(s.q, "fail") {
+		return nil, errFake
+	}
+
+	return &fakeRows{}, nil
+}
+
+type fakeRows struct{ n int }
+
+func (r *fakeRows) Columns() []string { return []string{"n"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.n >= fakeRowCount {
+		return io.EOF
+	}
+
+	r.n++
+	dest[0] = int64(r.n)
+	return nil
+}
+
+var registerFake sync.Once
+
+// openFake returns a DB of the fakeDriver, through sqlmetrics.
+func openFake(t *testing.T, o Options, fn LabelMaker) *sql.DB {
+	t.Helper()
+	return openFakeWith(t, o, fn.ToQueryLabelMaker())
+}
+
+func openFakeWith(t *testing.T, o Options, fn QueryLabelMaker) *sql.DB {
+	t.Helper()
+
+	registerFake.Do(func() { sql.Register(fakeDriverName, fakeDriver{}) })
+
+	o.Driver = fakeDriverName
+
+	// every test gets its own proxy, with its own Options.
+	name, err := register(o, fn, fakeDriverName+":"+t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open(name, fakeDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// querier is a *sql.DB or a *sql.Tx.
+type querier interface {
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}
+
+func queryAll(
+	ctx context.Context, db querier, q string, args ...interface{},
+) (int, error) {
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int
+	for rows.Next() {
+		n++
+	}
+
+	return n, rows.Err()
+}
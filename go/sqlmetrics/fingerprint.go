@@ -0,0 +1,643 @@
+package sqlmetrics
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The operations that FingerprintLabelMaker tells apart.
+const (
+	OperationSelect = "select"
+	OperationInsert = "insert"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+	OperationUpsert = "upsert"
+	OperationDDL    = "ddl"
+	OperationOther  = "other"
+)
+
+const (
+	// maxFingerprintLen bounds the per label, as some generated queries
+	// are long even once normalized.
+	maxFingerprintLen = 256
+	// maxTables bounds the table label of a query that joins many.
+	maxTables = 3
+)
+
+type tokenKind int
+
+const (
+	tokWord   tokenKind = iota // keywords and unquoted identifiers.
+	tokQuoted                  // "quoted" or `quoted` identifiers.
+	tokValue                   // literals.
+	tokParam                   // placeholders, $1, ? or :name.
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string // the identifier sans quotes, the placeholder or the punctuation.
+}
+
+func (t token) is(kw string) bool {
+	return t.kind == tokWord && strings.EqualFold(t.text, kw)
+}
+
+// tokenize splits a query in to tokens, dropping the comments and the
+// whitespace. Single quoted strings, dollar quoted strings and numbers are
+// all values, and placeholders ($1, ?, :name) are params. Double quotes
+// delimit identifiers, the ANSI and Postgres way, and so do MySQL's
+// backticks. A # starts a MySQL comment, unless it is Postgres' #> or #>>.
+func tokenize(q string) []token {
+	var out []token
+	r := []rune(q)
+	n := len(r)
+
+	for i := 0; i < n; {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '#' && i+1 < n && r[i+1] == '>':
+			// Postgres' #> and #>> json operators, not a MySQL comment.
+			start := i
+			i += 2
+			if i < n && r[i] == '>' {
+				i++
+			}
+			out = append(out, token{kind: tokPunct, text: string(r[start:i])})
+
+		case c == '-' && i+1 < n && r[i+1] == '-', c == '#':
+			for i < n && r[i] != '\n' {
+				i++
+			}
+
+		case c == '/' && i+1 < n && r[i+1] == '*':
+			i += 2
+			for i < n && !(r[i] == '*' && i+1 < n && r[i+1] == '/') {
+				i++
+			}
+			i += 2
+
+		case c == '\'':
+			i = skipQuoted(r, i, '\'')
+			out = append(out, token{kind: tokValue})
+
+		case c == '"' || c == '`':
+			end := skipQuoted(r, i, c)
+			text := string(r[i+1 : max(i+1, end-1)])
+			text = strings.ReplaceAll(text, string([]rune{c, c}), string(c))
+			out = append(out, token{kind: tokQuoted, text: text})
+			i = end
+
+		case c == '$' && i+1 < n && unicode.IsDigit(r[i+1]):
+			start := i
+			i++
+			for i < n && unicode.IsDigit(r[i]) {
+				i++
+			}
+			out = append(out, token{kind: tokParam, text: string(r[start:i])})
+
+		case c == '$':
+			i = skipDollarQuoted(r, i)
+			out = append(out, token{kind: tokValue})
+
+		case c == '?':
+			i++
+			out = append(out, token{kind: tokParam, text: "?"})
+
+		case c == ':' && i+1 < n && r[i+1] == ':':
+			i += 2
+			out = append(out, token{kind: tokPunct, text: "::"})
+
+		case c == ':' && i+1 < n && isWordRune(r[i+1]):
+			start := i
+			i++
+			for i < n && isWordRune(r[i]) {
+				i++
+			}
+			out = append(out, token{kind: tokParam, text: string(r[start:i])})
+
+		case unicode.IsDigit(c),
+			c == '.' && i+1 < n && unicode.IsDigit(r[i+1]):
+			for i < n && (isWordRune(r[i]) || r[i] == '.' ||
+				((r[i] == '+' || r[i] == '-') && (r[i-1] == 'e' || r[i-1] == 'E'))) {
+				i++
+			}
+			out = append(out, token{kind: tokValue})
+
+		case isWordRune(c) || c == '@':
+			start := i
+			i++
+			for i < n && (isWordRune(r[i]) || r[i] == '$') {
+				i++
+			}
+
+			// E'escaped', N'national', X'hex' and B'bits' are strings.
+			if i-start == 1 && i < n && r[i] == '\'' &&
+				strings.ContainsRune("EeNnXxBb", c) {
+				i = skipQuoted(r, i, '\'')
+				out = append(out, token{kind: tokValue})
+				continue
+			}
+
+			out = append(out, token{kind: tokWord, text: string(r[start:i])})
+
+		default:
+			i++
+			out = append(out, token{kind: tokPunct, text: string(c)})
+		}
+	}
+
+	return out
+}
+
+func isWordRune(c rune) bool {
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// skipQuoted returns the index past the closing quote, honoring doubled
+// quotes and backslash escapes.
+func skipQuoted(r []rune, i int, quote rune) int {
+	for i++; i < len(r); i++ {
+		switch r[i] {
+		case '\\':
+			i++
+		case quote:
+			if i+1 < len(r) && r[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+
+	return len(r)
+}
+
+// skipDollarQuoted returns the index past a $tag$ ... $tag$ string.
+func skipDollarQuoted(r []rune, i int) int {
+	j := i + 1
+	for j < len(r) && r[j] != '$' && isWordRune(r[j]) {
+		j++
+	}
+
+	if j >= len(r) || r[j] != '$' {
+		return i + 1 // a lone $, not a string.
+	}
+
+	tag := string(r[i : j+1])
+	rest := string(r[j+1:])
+	k := strings.Index(rest, tag)
+	if k < 0 {
+		return len(r)
+	}
+
+	return j + 1 + len([]rune(rest[:k])) + len([]rune(tag))
+}
+
+// queryShape is what FingerprintLabelMaker learns of a query.
+type queryShape struct {
+	fingerprint string
+	operation   string
+	tables      []string
+}
+
+// analyze fingerprints a query and finds its operation and tables.
+func analyze(q string) queryShape {
+	toks := tokenize(q)
+	return queryShape{
+		fingerprint: fingerprint(toks),
+		operation:   operation(toks),
+		tables:      tables(toks),
+	}
+}
+
+// Fingerprint normalizes a query such that the queries that differ only
+// in their literals, placeholders, IN-lists, comments, whitespace or
+// keyword case, have the same fingerprint.
+// Example:
+// select * from users where id in (1, 2, 3) -- hot path
+// SELECT * FROM users WHERE id IN ($1, $2)
+// both are SELECT * FROM users WHERE id IN (?+)
+func Fingerprint(q string) string {
+	return fingerprint(tokenize(q))
+}
+
+func fingerprint(toks []token) string {
+	var parts []string
+	for _, t := range toks {
+		switch t.kind {
+		case tokValue, tokParam:
+			parts = append(parts, "?")
+		case tokWord:
+			if isKeyword(t.text) {
+				parts = append(parts, strings.ToUpper(t.text))
+			} else {
+				parts = append(parts, t.text)
+			}
+		case tokQuoted:
+			if t.text == "" {
+				parts = append(parts, `""`)
+				continue
+			}
+			parts = append(parts, t.text)
+		default:
+			parts = append(parts, t.text)
+		}
+	}
+
+	parts = collapseLists(parts)
+	for len(parts) > 0 && parts[len(parts)-1] == ";" {
+		parts = parts[:len(parts)-1]
+	}
+
+	ddl := operation(toks) == OperationDDL
+	var b strings.Builder
+	for i, p := range parts {
+		if i > 0 && (spaced(parts[i-1], p) || columnList(parts, i, ddl)) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(p)
+	}
+
+	out := b.String()
+	if len(out) > maxFingerprintLen {
+		// cut on a rune boundary, as a label value has to be valid UTF-8.
+		cut := maxFingerprintLen
+		for cut > 0 && !utf8.RuneStart(out[cut]) {
+			cut--
+		}
+		out = out[:cut] + "..."
+	}
+
+	return out
+}
+
+// collapseLists turns (?, ?, ?) in to (?+) and (?+), (?+) in to (?+), so
+// that IN-lists and multi-row VALUES do not make a fingerprint per length.
+func collapseLists(parts []string) []string {
+	var out []string
+	for i := 0; i < len(parts); i++ {
+		if parts[i] == "(" {
+			j := i + 1
+			for j+1 < len(parts) && parts[j] == "?" && parts[j+1] == "," {
+				j += 2
+			}
+
+			if j+1 < len(parts) && parts[j] == "?" && parts[j+1] == ")" {
+				out = append(out, "(?+)")
+				i = j + 1
+				continue
+			}
+		}
+
+		out = append(out, parts[i])
+	}
+
+	var dedup []string
+	for _, p := range out {
+		k := len(dedup)
+		if p == "(?+)" && k >= 2 && dedup[k-1] == "," && dedup[k-2] == "(?+)" {
+			dedup = dedup[:k-1]
+			continue
+		}
+
+		dedup = append(dedup, p)
+	}
+
+	return dedup
+}
+
+// spaced reports whether a space goes between two parts. A function's
+// parenthesis sticks to its name, while a keyword's does not.
+func spaced(prev, next string) bool {
+	switch next {
+	case ",", ")", ".", "::", ";", "[", "]":
+		return false
+	case "(", "(?+)":
+		// prev is empty for an empty quoted identifier, like "".
+		r := []rune(prev)
+		if len(r) > 0 && isWordRune(r[len(r)-1]) && !isKeyword(prev) {
+			return false
+		}
+	}
+
+	switch prev {
+	case "(", ".", "::", "[":
+		return false
+	}
+
+	return true
+}
+
+// columnList reports whether the parenthesis at i opens the column list of
+// a table, as in INSERT INTO t (a, b) or REFERENCES t (id), rather than the
+// arguments of a function. It is spaced, as a keyword's parenthesis is.
+func columnList(parts []string, i int, ddl bool) bool {
+	if parts[i] != "(" {
+		return false
+	}
+
+	// back over the name, schema qualified or not.
+	j := i - 1
+	for j >= 2 && parts[j-1] == "." {
+		j -= 2
+	}
+
+	if j < 1 || isKeyword(parts[j]) {
+		return false
+	}
+
+	switch parts[j-1] {
+	case "INTO", "TABLE", "EXISTS", "REFERENCES":
+		return true
+	case "ON":
+		// CREATE INDEX i ON t (c), while in a join ON lower(a.x) is a call.
+		return ddl
+	}
+
+	return false
+}
+
+// operation finds the statement's operation, past the CTEs if any.
+func operation(toks []token) string {
+	i := skipCTEs(toks)
+	if i >= len(toks) {
+		return OperationOther
+	}
+
+	t := toks[i]
+	switch {
+	case t.is("SELECT"), t.is("VALUES"), t.is("TABLE"):
+		return OperationSelect
+	case t.is("UPDATE"):
+		return OperationUpdate
+	case t.is("DELETE"):
+		return OperationDelete
+	case t.is("REPLACE"), t.is("MERGE"), t.is("UPSERT"):
+		return OperationUpsert
+	case t.is("INSERT"):
+		for j := i + 1; j+1 < len(toks); j++ {
+			if (toks[j].is("ON") && toks[j+1].is("CONFLICT")) ||
+				(toks[j].is("ON") && toks[j+1].is("DUPLICATE")) {
+				return OperationUpsert
+			}
+		}
+		return OperationInsert
+	case t.is("CREATE"), t.is("ALTER"), t.is("DROP"), t.is("TRUNCATE"),
+		t.is("RENAME"), t.is("COMMENT"), t.is("GRANT"), t.is("REVOKE"):
+		return OperationDDL
+	}
+
+	return OperationOther
+}
+
+// skipCTEs returns the index of the first token past a WITH clause.
+func skipCTEs(toks []token) int {
+	i := 0
+	for i < len(toks) && toks[i].is("(") {
+		i++
+	}
+
+	if i >= len(toks) || !toks[i].is("WITH") {
+		return i
+	}
+
+	i++
+	if i < len(toks) && toks[i].is("RECURSIVE") {
+		i++
+	}
+
+	for i < len(toks) {
+		// name [(columns)] AS [NOT] [MATERIALIZED] ( ... ) [,]
+		for i < len(toks) && !(toks[i].kind == tokPunct && toks[i].text == "(" &&
+			i > 0 && (toks[i-1].is("AS") || toks[i-1].is("MATERIALIZED"))) {
+			i++
+		}
+
+		i = skipParens(toks, i)
+		if i < len(toks) && toks[i].kind == tokPunct && toks[i].text == "," {
+			i++
+			continue
+		}
+
+		return i
+	}
+
+	return i
+}
+
+// skipParens returns the index past the parenthesis that opens at i.
+func skipParens(toks []token, i int) int {
+	depth := 0
+	for ; i < len(toks); i++ {
+		if toks[i].kind != tokPunct {
+			continue
+		}
+
+		switch toks[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+
+	return i
+}
+
+// cteNames returns the names that a WITH clause defines.
+func cteNames(toks []token) map[string]bool {
+	names := map[string]bool{}
+	for i := 0; i+1 < len(toks); i++ {
+		if !toks[i+1].is("AS") || !isName(toks[i]) {
+			continue
+		}
+
+		// name AS ( or name (cols) AS (
+		if i+2 < len(toks) && toks[i+2].kind == tokPunct && toks[i+2].text == "(" {
+			names[strings.ToLower(toks[i].text)] = true
+		}
+	}
+
+	// the (cols) form, name ( ... ) AS (
+	for i := 0; i+1 < len(toks); i++ {
+		if isName(toks[i]) && toks[i+1].kind == tokPunct && toks[i+1].text == "(" {
+			j := skipParens(toks, i+1)
+			if j+1 < len(toks) && toks[j].is("AS") &&
+				toks[j+1].kind == tokPunct && toks[j+1].text == "(" {
+				names[strings.ToLower(toks[i].text)] = true
+			}
+		}
+	}
+
+	return names
+}
+
+func isName(t token) bool {
+	return t.kind == tokQuoted || (t.kind == tokWord && !isKeyword(t.text))
+}
+
+// tables finds the tables that a query reads or writes: those after FROM
+// and JOIN, outside of function calls like EXTRACT(... FROM ...), the one
+// after UPDATE and INTO, and after TABLE in DDL. The names that CTEs
+// define are not tables.
+func tables(toks []token) []string {
+	op := operation(toks)
+	ctes := cteNames(toks)
+	seen := map[string]bool{}
+	var out []string
+
+	add := func(i int) int {
+		for i < len(toks) && (toks[i].is("ONLY") || toks[i].is("LATERAL") ||
+			toks[i].is("IF") || toks[i].is("NOT") || toks[i].is("EXISTS") ||
+			toks[i].is("LOW_PRIORITY") || toks[i].is("IGNORE") ||
+			toks[i].is("QUICK")) {
+			i++
+		}
+
+		if i >= len(toks) || !isName(toks[i]) {
+			return i
+		}
+
+		first := i
+		name := toks[i].text
+		for i+2 < len(toks) && toks[i+1].kind == tokPunct &&
+			toks[i+1].text == "." && isName(toks[i+2]) {
+			name += "." + toks[i+2].text
+			i += 2
+		}
+
+		// a function, like generate_series(...), is not a table, but the
+		// column list of INSERT INTO t (...) or CREATE TABLE t (...) is.
+		prev := toks[first-1]
+		if i+1 < len(toks) && toks[i+1].kind == tokPunct && toks[i+1].text == "(" &&
+			(prev.is("FROM") || prev.is("JOIN") || prev.text == ",") {
+			return i + 1
+		}
+
+		if !ctes[strings.ToLower(name)] && !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+
+		return i + 1
+	}
+
+	// stack tells, per open parenthesis, whether it's a subquery and if so,
+	// whether it is in the FROM list, as in FROM a AS x JOIN b ON ..., c.
+	// Keeping track as it goes, rather than looking back at every comma,
+	// keeps a multi-row INSERT of thousands of rows linear.
+	stack := []parenScope{{sub: true}}
+	start := skipCTEs(toks)
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		top := &stack[len(stack)-1]
+		if t.kind == tokPunct {
+			switch t.text {
+			case "(":
+				sub := i+1 < len(toks) && (toks[i+1].is("SELECT") || toks[i+1].is("WITH"))
+				stack = append(stack, parenScope{sub: sub || (i > 0 && toks[i-1].is("AS"))})
+			case ")":
+				if len(stack) > 1 {
+					stack = stack[:len(stack)-1]
+				}
+			case ",":
+				// FROM a, b
+				if top.sub && top.from {
+					i = add(i+1) - 1
+				}
+			}
+			continue
+		}
+
+		if t.kind == tokWord && isKeyword(t.text) {
+			top.from = t.is("FROM") || (top.from && fromKeywords[strings.ToUpper(t.text)])
+		}
+
+		if !top.sub {
+			continue
+		}
+
+		switch {
+		case t.is("FROM"), t.is("JOIN"):
+			i = add(i+1) - 1
+		case t.is("UPDATE") && i == start:
+			i = add(i+1) - 1
+		case t.is("INTO") && (op == OperationInsert || op == OperationUpsert):
+			i = add(i+1) - 1
+		case t.is("TABLE") && op == OperationDDL:
+			i = add(i+1) - 1
+		case t.is("ON") && op == OperationDDL && i > 0 && isName(toks[i-1]):
+			// CREATE INDEX name ON table
+			i = add(i+1) - 1
+		}
+
+		if len(out) == maxTables {
+			break
+		}
+	}
+
+	return out
+}
+
+// parenScope is what tables knows of the query, within a parenthesis.
+type parenScope struct {
+	sub  bool // a subquery, which may name tables.
+	from bool // in the FROM list, since the last FROM.
+}
+
+// fromKeywords may come between FROM and the comma of a FROM list, as
+// in FROM a AS x JOIN b ON x.id = b.id AND b.ok, c
+var fromKeywords = map[string]bool{}
+
+func init() {
+	for _, k := range strings.Fields(`
+		AND AS BETWEEN CROSS FALSE FULL IN INNER IS JOIN LATERAL LEFT LIKE
+		NATURAL NOT NULL ON ONLY OR OUTER RIGHT TRUE USING`) {
+		fromKeywords[k] = true
+	}
+}
+
+// FingerprintLabelMaker is a LabelMaker that fills per with the query's
+// Fingerprint, operation with one of the Operation* constants and table
+// with the tables it reads or writes, at most 3, comma separated.
+// How to use?
+// sqlmetrics.RegisterDriverWithLabelMaker(o, sqlmetrics.FingerprintLabelMaker)
+func FingerprintLabelMaker(q string) LabelSet {
+	s := analyze(q)
+	return LabelSet{
+		"per":       s.fingerprint,
+		"operation": s.operation,
+		"table":     strings.Join(s.tables, ","),
+	}
+}
+
+// keywords are uppercased in a fingerprint and are never table names.
+var keywords = map[string]bool{}
+
+func init() {
+	for _, k := range strings.Fields(`
+		ADD ALL ALTER AND ANY AS ASC BETWEEN BY CASE CAST COLUMN COMMENT
+		CONFLICT CONSTRAINT CREATE CROSS CURRENT_DATE CURRENT_TIMESTAMP
+		DATABASE DEFAULT DELETE DESC DISTINCT DO DROP DUPLICATE ELSE END
+		EXCEPT EXISTS EXPLAIN FALSE FETCH FIRST FOR FROM FULL GRANT GROUP
+		HAVING IF IGNORE ILIKE IN INDEX INNER INSERT INTERSECT INTO IS JOIN
+		KEY LATERAL LEFT LIKE LIMIT LOW_PRIORITY MATERIALIZED MERGE NATURAL
+		NEXT NOT NOTHING NULL OFFSET ON ONLY OR ORDER OUTER OVER PARTITION
+		PRIMARY QUICK RECURSIVE REFERENCES RENAME REPLACE RETURNING REVOKE
+		RIGHT ROWS SCHEMA SELECT SET SHOW TABLE THEN TO TRUE TRUNCATE UNION
+		UNIQUE UPDATE UPSERT USING VALUES VIEW WHEN WHERE WINDOW WITH`) {
+		keywords[k] = true
+	}
+}
+
+func isKeyword(w string) bool {
+	return keywords[strings.ToUpper(w)]
+}
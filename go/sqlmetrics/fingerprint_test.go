@@ -0,0 +1,224 @@
+package sqlmetrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	for _, c := range []struct {
+		name, query, fingerprint, operation, tables string
+	}{
+		{
+			name:        "literals and IN-lists",
+			query:       "select * from users where id in (1, 2, 3) and name = 'o''neil'",
+			fingerprint: "SELECT * FROM users WHERE id IN (?+) AND name = ?",
+			operation:   OperationSelect,
+			tables:      "users",
+		},
+		{
+			name:        "postgres placeholders and casts",
+			query:       "SELECT id FROM public.users WHERE id = ANY($1::int[]) AND email = E'a\\'b'",
+			fingerprint: "SELECT id FROM public.users WHERE id = ANY (?::int[]) AND email = ?",
+			operation:   OperationSelect,
+			tables:      "public.users",
+		},
+		{
+			name:        "comments",
+			query:       "/* api:list */ SELECT n -- the count\nFROM t # mysql\n",
+			fingerprint: "SELECT n FROM t",
+			operation:   OperationSelect,
+			tables:      "t",
+		},
+		{
+			name:        "postgres json path operators",
+			query:       "SELECT data #>> '{a,b}', data #> '{c}' FROM users WHERE id = $1 # trailing",
+			fingerprint: "SELECT data #>> ?, data #> ? FROM users WHERE id = ?",
+			operation:   OperationSelect,
+			tables:      "users",
+		},
+		{
+			name:        "joins and quoted identifiers",
+			query:       `SELECT * FROM "Orders" o JOIN ` + "`items`" + ` i ON i.oid = o.id, users u`,
+			fingerprint: "SELECT * FROM Orders o JOIN items i ON i.oid = o.id, users u",
+			operation:   OperationSelect,
+			tables:      "Orders,items,users",
+		},
+		{
+			name:        "function calls are not tables",
+			query:       "SELECT extract(year from ts) FROM generate_series(1, 10), events",
+			fingerprint: "SELECT extract(year FROM ts) FROM generate_series(?+), events",
+			operation:   OperationSelect,
+			tables:      "events",
+		},
+		{
+			name:        "CTEs",
+			query:       "WITH recent AS (SELECT * FROM orders WHERE ts > now() - $1) DELETE FROM recent USING items WHERE id IN (SELECT id FROM archived)",
+			fingerprint: "WITH recent AS (SELECT * FROM orders WHERE ts > now() - ?) DELETE FROM recent USING items WHERE id IN (SELECT id FROM archived)",
+			operation:   OperationDelete,
+			tables:      "orders,archived",
+		},
+		{
+			name:        "multi-row insert",
+			query:       "INSERT INTO users (id, name) VALUES (1, 'a'), (2, 'b'), (3, 'c');",
+			fingerprint: "INSERT INTO users (id, name) VALUES (?+)",
+			operation:   OperationInsert,
+			tables:      "users",
+		},
+		{
+			name:        "postgres upsert",
+			query:       "INSERT INTO kv (k, v) VALUES ($1, $2) ON CONFLICT (k) DO UPDATE SET v = excluded.v",
+			fingerprint: "INSERT INTO kv (k, v) VALUES (?+) ON CONFLICT (k) DO UPDATE SET v = excluded.v",
+			operation:   OperationUpsert,
+			tables:      "kv",
+		},
+		{
+			name:        "mysql upsert",
+			query:       "INSERT INTO kv (k, v) VALUES (?, ?) ON DUPLICATE KEY UPDATE v = VALUES(v)",
+			fingerprint: "INSERT INTO kv (k, v) VALUES (?+) ON DUPLICATE KEY UPDATE v = VALUES (v)",
+			operation:   OperationUpsert,
+			tables:      "kv",
+		},
+		{
+			name:        "qualified insert",
+			query:       "insert into app.users(id) values ($1)",
+			fingerprint: "INSERT INTO app.users (id) VALUES (?+)",
+			operation:   OperationInsert,
+			tables:      "app.users",
+		},
+		{
+			name:        "call in a join",
+			query:       "SELECT * FROM a JOIN b ON lower(a.x) = b.y, c",
+			fingerprint: "SELECT * FROM a JOIN b ON lower(a.x) = b.y, c",
+			operation:   OperationSelect,
+			tables:      "a,b,c",
+		},
+		{
+			name:        "update",
+			query:       "UPDATE LOW_PRIORITY accounts SET balance = balance - 10.5e2 WHERE id = :id",
+			fingerprint: "UPDATE LOW_PRIORITY accounts SET balance = balance - ? WHERE id = ?",
+			operation:   OperationUpdate,
+			tables:      "accounts",
+		},
+		{
+			name:        "dollar quoted",
+			query:       "SELECT $tag$it's $1$tag$, $$x$$ FROM t",
+			fingerprint: "SELECT ?, ? FROM t",
+			operation:   OperationSelect,
+			tables:      "t",
+		},
+		{
+			name:        "ddl",
+			query:       "CREATE TABLE IF NOT EXISTS events(id bigint PRIMARY KEY, user_id bigint REFERENCES users(id))",
+			fingerprint: "CREATE TABLE IF NOT EXISTS events (id bigint PRIMARY KEY, user_id bigint REFERENCES users (id))",
+			operation:   OperationDDL,
+			tables:      "events",
+		},
+		{
+			name:        "index ddl",
+			query:       "create index idx_ts on events (ts)",
+			fingerprint: "CREATE INDEX idx_ts ON events (ts)",
+			operation:   OperationDDL,
+			tables:      "events",
+		},
+		{
+			name:        "other",
+			query:       "SET search_path TO app",
+			fingerprint: "SET search_path TO app",
+			operation:   OperationOther,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ls := FingerprintLabelMaker(c.query)
+			assert.Equal(t, c.fingerprint, ls["per"])
+			assert.Equal(t, c.operation, ls["operation"])
+			assert.Equal(t, c.tables, ls["table"])
+		})
+	}
+
+	t.Run("bounded", func(t *testing.T) {
+		q := "SELECT " + strings.Repeat("a_long_column_name, ", 50) + "x FROM t"
+		assert.Equal(t, maxFingerprintLen+3, len(Fingerprint(q)))
+
+		// multi-byte runes straddling the bound are not split.
+		q = "SELECT " + strings.Repeat("é", 200) + " FROM t"
+		fp := Fingerprint(q)
+		assert.Assert(t, utf8.ValidString(fp))
+		assert.Assert(t, len(fp) <= maxFingerprintLen+3)
+		assert.Equal(t, "SELECT "+strings.Repeat("é", 124)+"...", fp)
+
+		q = "SELECT * FROM a JOIN b ON true JOIN c ON true JOIN d ON true"
+		assert.Equal(t, "a,b,c", FingerprintLabelMaker(q)["table"])
+	})
+
+	t.Run("large multi-row insert", func(t *testing.T) {
+		ls := FingerprintLabelMaker(largeInsert(20000))
+		assert.Equal(t, "INSERT INTO events (id, name, ts) VALUES (?+)", ls["per"])
+		assert.Equal(t, OperationInsert, ls["operation"])
+		assert.Equal(t, "events", ls["table"])
+	})
+
+	t.Run("empty identifiers", func(t *testing.T) {
+		for q, expected := range map[string]string{
+			`SELECT "" (1)`:       `SELECT "" (?+)`,
+			"SELECT `` (1)":       `SELECT "" (?+)`,
+			`SELECT ""(1) FROM t`: `SELECT "" (?+) FROM t`,
+		} {
+			ls := FingerprintLabelMaker(q)
+			assert.Equal(t, expected, ls["per"], q)
+			assert.Equal(t, OperationSelect, ls["operation"], q)
+		}
+	})
+
+	t.Run("labels", func(t *testing.T) {
+		resetMetrics()
+		EnableSnapshots()
+
+		db := openFake(t, Options{}, FingerprintLabelMaker)
+		for _, id := range []string{"1", "2", "3"} {
+			_, err := queryAll(context.Background(), db, "SELECT n FROM users WHERE id = "+id)
+			assert.NilError(t, err)
+		}
+
+		assert.Equal(t, 1, testutil.CollectAndCount(
+			sqlQueryDuration, "last9_sql_query_duration_milliseconds",
+		))
+
+		snaps := Snapshot(time.Minute)
+		assert.Equal(t, 1, len(snaps))
+		assert.Equal(t, uint64(3), snaps[0].Count)
+		ls := snaps[0].Labels
+		assert.Equal(t, "SELECT n FROM users WHERE id = ?", ls["per"])
+		assert.Equal(t, OperationSelect, ls["operation"])
+		assert.Equal(t, "users", ls["table"])
+	})
+}
+
+// largeInsert is a multi-row INSERT of n rows.
+func largeInsert(n int) string {
+	var b strings.Builder
+	b.WriteString("INSERT INTO events (id, name, ts) VALUES ")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "(%d, 'event %d', %d)", i, i, i)
+	}
+
+	return b.String()
+}
+
+func BenchmarkFingerprintLabelMaker(b *testing.B) {
+	q := largeInsert(20000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FingerprintLabelMaker(q)
+	}
+}
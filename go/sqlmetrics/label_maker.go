@@ -1,5 +1,10 @@
 package sqlmetrics
 
+import (
+	"context"
+	"database/sql/driver"
+)
+
 type LabelSet map[string]string
 
 // Merge accepts a set of LabelSets and merge them into this LabelSet.
@@ -20,10 +25,85 @@ func (l LabelSet) ToMap() map[string]string {
 	return map[string]string(l)
 }
 
+type labelsKey struct{}
+
+// WithLabels returns a context that tags the statements run with it, and
+// the transactions begun with it, with ls. They take precedence over what
+// the LabelMaker makes of the query, and merge with the labels of the
+// parent context, if any. A logical name as per, tenant and cluster are
+// the usual ones.
+// How to use?
+// ctx = sqlmetrics.WithLabels(ctx, sqlmetrics.LabelSet{"tenant": tenant})
+// db.QueryContext(ctx, "SELECT ...")
+func WithLabels(ctx context.Context, ls LabelSet) context.Context {
+	merged := LabelSet{}.Merge(labelsFrom(ctx), ls)
+	return context.WithValue(ctx, labelsKey{}, merged)
+}
+
+// labelsFrom returns the labels of WithLabels, nil if none.
+func labelsFrom(ctx context.Context) LabelSet {
+	if ctx == nil {
+		return nil
+	}
+
+	ls, _ := ctx.Value(labelsKey{}).(LabelSet)
+	return ls
+}
+
 // A type that user can extend to Parse a query and extract less verbose
 // or more relevant labels out of it.
 type LabelMaker func(string) LabelSet
 
+// ToQueryLabelMaker adapts a LabelMaker, which only sees the query.
+func (fn LabelMaker) ToQueryLabelMaker() QueryLabelMaker {
+	return func(qi QueryInfo) LabelSet {
+		return fn(qi.Query)
+	}
+}
+
+// The kind label of a statement.
+const (
+	KindExec    = "exec"
+	KindQuery   = "query"
+	KindPrepare = "prepare"
+)
+
+// QueryInfo is what there is to know of a statement, before it runs.
+type QueryInfo struct {
+	Context context.Context
+	Query   string
+
+	// Kind is one of KindExec, KindQuery and KindPrepare.
+	Kind string
+
+	// Args are none for KindPrepare.
+	Args []driver.NamedValue
+
+	// DBName and DBHost are of the connection, read from its DSN.
+	DBName string
+	DBHost string
+
+	// InTx tells whether the connection is in a transaction.
+	InTx bool
+
+	// Prepared tells an execution of a prepared statement from an ad-hoc
+	// one. The one that database/sql prepares on its own, as the driver
+	// skipped the ad-hoc statement with driver.ErrSkip, is ad-hoc.
+	Prepared bool
+}
+
+// QueryLabelMaker is a LabelMaker that sees all of QueryInfo, so that the
+// labels can tell apart what the query alone does not, without parsing
+// the query twice.
+// How to use?
+//
+//	sqlmetrics.RegisterDriverWithQueryLabelMaker(o, func(qi QueryInfo) LabelSet {
+//		ls := sqlmetrics.FingerprintLabelMaker(qi.Query)
+//		ls["tenant"] = tenantOf(qi.Context)
+//		return ls
+//	})
+type QueryLabelMaker func(QueryInfo) LabelSet
+
 const idealLabelLen = 20
 
 // The default labelSet to be exported is just a query, that too trimmed down
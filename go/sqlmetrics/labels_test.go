@@ -0,0 +1,86 @@
+package sqlmetrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+)
+
+func TestWithLabels(t *testing.T) {
+	resetMetrics()
+	EnableSnapshots()
+
+	db := openFake(t, Options{}, func(q string) LabelSet {
+		return LabelSet{"per": q[:6], "tenant": "from-query"}
+	})
+
+	ctx := WithLabels(context.Background(), LabelSet{"tenant": "acme"})
+	ctx = WithLabels(ctx, LabelSet{"per": "list_users", "cluster": "c1"})
+	assert.DeepEqual(t, LabelSet{
+		"tenant": "acme", "per": "list_users", "cluster": "c1",
+	}, labelsFrom(ctx))
+
+	_, err := queryAll(ctx, db, "SELECT n FROM users")
+	assert.NilError(t, err)
+
+	snaps := Snapshot(time.Minute)
+	assert.Equal(t, 1, len(snaps))
+	assert.Equal(t, "list_users", snaps[0].Labels["per"])
+	assert.Equal(t, "acme", snaps[0].Labels["tenant"])
+	assert.Equal(t, "c1", snaps[0].Labels["cluster"])
+
+	// a transaction has the labels of the context that began it.
+	tx, err := db.BeginTx(ctx, nil)
+	assert.NilError(t, err)
+	assert.NilError(t, tx.Commit())
+
+	labels := dbLabelSet(&connInfo{dbName: "app", dbHost: "db.internal:5432"})
+	labels.Merge(LabelSet{"tenant": "acme", "cluster": "c1", "outcome": outcomeCommit})
+	assert.Equal(t, 1.0, testutil.ToFloat64(sqlTxTotal.With(labels.ToMap())))
+}
+
+func TestQueryLabelMaker(t *testing.T) {
+	resetMetrics()
+	EnableSnapshots()
+	ctx := context.Background()
+
+	var seen []QueryInfo
+	db := openFakeWith(t, Options{}, func(qi QueryInfo) LabelSet {
+		seen = append(seen, qi)
+		return LabelSet{"per": qi.Query[:6], "kind": "ignored"}
+	})
+
+	_, err := db.ExecContext(ctx, "UPDATE t SET n = $1", 1)
+	assert.NilError(t, err)
+
+	tx, err := db.BeginTx(ctx, nil)
+	assert.NilError(t, err)
+	_, err = queryAll(ctx, tx, "SELECT n FROM t")
+	assert.NilError(t, err)
+
+	stmt, err := tx.PrepareContext(ctx, "DELETE FROM t")
+	assert.NilError(t, err)
+	assert.NilError(t, stmt.Close())
+	assert.NilError(t, tx.Commit())
+
+	assert.Equal(t, 3, len(seen))
+	for i, kind := range []string{KindExec, KindQuery, KindPrepare} {
+		assert.Equal(t, kind, seen[i].Kind)
+		assert.Equal(t, "app", seen[i].DBName)
+		assert.Equal(t, "db.internal:5432", seen[i].DBHost)
+		assert.Equal(t, i > 0, seen[i].InTx)
+	}
+	assert.Equal(t, 1, len(seen[0].Args))
+	assert.Equal(t, int64(1), seen[0].Args[0].Value)
+
+	kinds := map[string]bool{}
+	for _, s := range Snapshot(time.Minute) {
+		kinds[s.Labels["kind"]] = true
+	}
+	assert.DeepEqual(t, map[string]bool{
+		KindExec: true, KindQuery: true, KindPrepare: true,
+	}, kinds)
+}
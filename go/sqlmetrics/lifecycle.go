@@ -0,0 +1,99 @@
+package sqlmetrics
+
+import (
+	"time"
+
+	"github.com/last9/last9-cdk/go/proc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	connOpenLabels = append([]string{"error_class"}, dbLabels...)
+
+	// emitted as last9_sql_connection_open_duration_milliseconds and/or
+	// last9_sql_connection_open_duration_seconds, read SetDurationUnits.
+	connOpenDuration = proc.NewDurationHistogram(
+		proc.DurationHistogramOpts{
+			Namespace: proc.Namespace,
+			Subsystem: subsystem,
+			Name:      "connection_open_duration",
+			Help:      "Time taken to open a connection, that opened",
+		},
+		dbLabels,
+	)
+
+	connOpenFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prometheus.BuildFQName(
+				proc.Namespace,
+				subsystem,
+				"connection_open_failures_total",
+			),
+			Help: "Connections that failed to open, per error_class",
+		},
+		connOpenLabels,
+	)
+
+	connLifetime = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: prometheus.BuildFQName(
+				proc.Namespace,
+				subsystem,
+				"connection_lifetime_seconds",
+			),
+			Help: "Time from open to close of a connection",
+			Buckets: []float64{
+				1, 10, 60, 300, 900, 1800, 3600, 3 * 3600, 6 * 3600, 24 * 3600,
+			},
+		},
+		dbLabels,
+	)
+
+	connClosed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prometheus.BuildFQName(
+				proc.Namespace,
+				subsystem,
+				"connections_closed_total",
+			),
+			Help: "Connections that were closed",
+		},
+		dbLabels,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(connOpenDuration)
+	prometheus.MustRegister(connOpenFailures)
+	prometheus.MustRegister(connLifetime)
+	prometheus.MustRegister(connClosed)
+}
+
+// openCtx is handed from PreOpen to PostOpen.
+type openCtx struct {
+	dsn   string
+	start time.Time
+}
+
+// openedConn records a connection that opened.
+func openedConn(info *connInfo, start time.Time) {
+	connOpenDuration.Observe(dbLabelSet(info).ToMap(), time.Since(start))
+}
+
+// failedOpen records a connection that failed to open, labeled with what
+// there is of its DSN.
+func failedOpen(dsn string, class string) {
+	info, _ := parseDSN(dsn)
+	labels := dbLabelSet(info)
+	labels["error_class"] = class
+	connOpenFailures.With(labels.ToMap()).Inc()
+}
+
+// closedConn records a connection that was closed.
+func closedConn(info *connInfo) {
+	labels := dbLabelSet(info).ToMap()
+	connClosed.With(labels).Inc()
+	if info != nil {
+		connLifetime.With(labels).Observe(time.Since(info.createdAt).Seconds())
+	}
+}
@@ -0,0 +1,59 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+)
+
+func connCount() int {
+	var n int
+	connMap.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+
+	return n
+}
+
+func TestConnectionLifecycle(t *testing.T) {
+	resetMetrics()
+	ctx := context.Background()
+	before := connCount()
+
+	db := openFake(t, Options{}, defaultLabelMaker)
+	db.SetMaxIdleConns(2)
+
+	// two connections, at once.
+	c1, err := db.Conn(ctx)
+	assert.NilError(t, err)
+	c2, err := db.Conn(ctx)
+	assert.NilError(t, err)
+	assert.NilError(t, c1.Close())
+	assert.NilError(t, c2.Close())
+	assert.Equal(t, before+2, connCount())
+	assert.Equal(t, 1, testutil.CollectAndCount(connOpenDuration))
+
+	labels := dbLabelSet(&connInfo{dbName: "app", dbHost: "db.internal:5432"})
+	assert.NilError(t, db.Close())
+	assert.Equal(t, before, connCount())
+	assert.Equal(t, 2.0, testutil.ToFloat64(connClosed.With(labels.ToMap())))
+	assert.Equal(t, 1, testutil.CollectAndCount(connLifetime))
+
+	// a connection that does not open.
+	refused, err := sql.Open(
+		fakeDriverName+":"+t.Name(), "postgres://fake@refused.internal/app",
+	)
+	assert.NilError(t, err)
+	defer refused.Close()
+
+	assert.ErrorContains(t, refused.PingContext(ctx), "connection refused")
+
+	labels = dbLabelSet(&connInfo{dbName: "app", dbHost: "refused.internal"})
+	labels["error_class"] = ErrorClassConnection
+	assert.Equal(t, 1.0, testutil.ToFloat64(connOpenFailures.With(labels.ToMap())))
+	assert.Equal(t, before, connCount())
+}
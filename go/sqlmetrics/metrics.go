@@ -10,19 +10,19 @@ import (
 var (
 	subsystem     = "sql"
 	defaultLabels = []string{
-		"per", proc.LabelHostname, "table", "dbname", "dbhost", "status",
+		"per", proc.LabelHostname, "table", "operation", "kind", "prepared",
+		"dbname", "dbhost", "status", "error_class",
 		proc.LabelProgram, proc.LabelTenant, proc.LabelCluster,
 	}
 
-	sqlQueryDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name: prometheus.BuildFQName(
-				proc.Namespace,
-				subsystem,
-				"query_duration_milliseconds",
-			),
-			Help:    "SQL duration per query",
-			Buckets: proc.LatencyBins,
+	// emitted as last9_sql_query_duration_milliseconds and/or
+	// last9_sql_query_duration_seconds, read SetDurationUnits.
+	sqlQueryDuration = proc.NewDurationHistogram(
+		proc.DurationHistogramOpts{
+			Namespace: proc.Namespace,
+			Subsystem: subsystem,
+			Name:      "query_duration",
+			Help:      "SQL duration per query",
 		},
 		defaultLabels,
 	)
@@ -33,29 +33,54 @@ func init() {
 	prometheus.MustRegister(sqlQueryDuration)
 }
 
+// SetDurationUnits chooses the unit(s) that query, rows, transaction and
+// connection open durations are recorded in. Milliseconds is the default, for
+// compatibility. Passing both Milliseconds and Seconds emits both metrics
+// during a migration.
+func SetDurationUnits(units ...proc.DurationUnit) {
+	sqlQueryDuration.SetUnits(units...)
+	sqlTxDuration.SetUnits(units...)
+	sqlRowsDuration.SetUnits(units...)
+	connOpenDuration.SetUnits(units...)
+}
+
+// SetBuckets picks the bucket layout, in milliseconds, for the query
+// duration histogram. proc.PresetDB is a good start for most databases.
+// Call it before the first query as it drops whatever was recorded. The
+// layout is shared by every registered driver, as they all emit in to
+// the one histogram.
+func SetBuckets(ms []float64) error {
+	return sqlQueryDuration.SetBuckets(ms)
+}
+
 func emitDuration(
 	ls LabelSet, status queryStatus, start time.Time,
 ) error {
+	labels := makeLabels(ls, defaultLabels)
+	labels["status"] = status.String()
+
+	d := time.Since(start)
+	sqlQueryDuration.Observe(labels.ToMap(), d)
+	observeWindow(labels.ToMap(), d, status == failure)
+
+	return nil
+}
+
+// makeLabels returns every one of keys, filled from ls where it has them.
+func makeLabels(ls LabelSet, keys []string) LabelSet {
 	labels := LabelSet{}
-	for _, k := range defaultLabels {
+	for _, k := range keys {
 		labels[k] = ""
 	}
 
 	labels[proc.LabelProgram] = proc.GetProgamName()
 	labels[proc.LabelHostname] = proc.GetHostname()
-	labels["status"] = status.String()
 
 	for k, v := range ls {
-		for _, l := range defaultLabels {
-			if k == l && v != "" {
-				labels[k] = v
-			}
+		if _, ok := labels[k]; ok && v != "" {
+			labels[k] = v
 		}
 	}
 
-	sqlQueryDuration.With(labels.ToMap()).Observe(
-		float64(time.Since(start).Milliseconds()),
-	)
-
-	return nil
+	return labels
 }
@@ -35,7 +35,13 @@ func getDB() (*sql.DB, error) {
 }
 
 func resetMetrics() {
-	tests.ResetMetrics(sqlQueryDuration)
+	tests.ResetMetrics(
+		sqlQueryDuration, queryWindows,
+		sqlTxDuration, sqlTxTotal, sqlTxCommitFailures, sqlTxStatements,
+		sqlRowsAffected, sqlRowsReturned, sqlRowsDuration,
+		preparedOpen, preparedPerConnection,
+		connOpenDuration, connOpenFailures, connLifetime, connClosed,
+	)
 }
 
 var expectedMetric = prometheus.BuildFQName(
@@ -121,19 +127,19 @@ func TestPq(t *testing.T) {
 	})
 
 	t.Run("conn metrics", func(t *testing.T) {
-		dsn := getDSN()
-		labels, err := makeStatsLabels(dsn)
+		db, err := getDB()
 		if err != nil {
 			t.Fatal(err)
 		}
+		defer db.Close()
 
-		db, err := getDB()
+		c, err := NewDBStatsCollector("pq", db, getDSN())
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer db.Close()
 
-		emitStats(db.Stats(), labels)
+		prometheus.MustRegister(c)
+		defer prometheus.Unregister(c)
 
 		o, err := tests.GetMetrics(srv.URL)
 		if err != nil {
@@ -152,7 +158,7 @@ func TestPq(t *testing.T) {
 		assert.Equal(t, true, ok)
 		assert.Equal(t, max.GetType(), dto.MetricType_GAUGE)
 
-		wait_duration, ok := o["last9_sql_connections_wait_duration_total"]
+		wait_duration, ok := o["last9_sql_connections_wait_duration_seconds_total"]
 		assert.Equal(t, true, ok)
 		assert.Equal(t, wait_duration.GetType(), dto.MetricType_COUNTER)
 
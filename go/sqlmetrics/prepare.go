@@ -0,0 +1,155 @@
+package sqlmetrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/last9/last9-cdk/go/proc"
+	"github.com/prometheus/client_golang/prometheus"
+	proxy "github.com/shogo82148/go-sql-proxy"
+)
+
+// The durations and the failures of Prepare are those of
+// last9_sql_query_duration with kind="prepare". The executions of the
+// prepared statements have prepared="true", the ad-hoc ones "false", so
+// that as many prepares as prepared executions of a per tell of an app
+// that prepares a statement on every call.
+//
+// A driver may decline an ad-hoc statement with driver.ErrSkip, as MySQL
+// does unless it interpolates the arguments, for database/sql to prepare,
+// execute and close it instead. That is recorded as the ad-hoc statement
+// that the app ran, prepared="false", and not as a prepare and a prepared
+// execution. A driver that cannot run a statement ad-hoc at all gets no
+// hooks for the attempt, so that its statements can not be told from the
+// ones that the app prepares, executes once and closes.
+var (
+	preparedOpen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prometheus.BuildFQName(
+				proc.Namespace,
+				subsystem,
+				"prepared_statements_open",
+			),
+			Help: "Prepared statements that are open, across connections",
+		},
+		dbLabels,
+	)
+
+	preparedPerConnection = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: prometheus.BuildFQName(
+				proc.Namespace,
+				subsystem,
+				"prepared_statements_per_connection",
+			),
+			Help:    "Prepared statements open on a connection, as of every Prepare",
+			Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+		},
+		dbLabels,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(preparedOpen)
+	prometheus.MustRegister(preparedPerConnection)
+}
+
+// stmtCounts is the number of prepared statements open per connection.
+var stmtCounts sync.Map
+
+func stmtCount(conn *proxy.Conn) *int64 {
+	n, _ := stmtCounts.LoadOrStore(conn, new(int64))
+	return n.(*int64)
+}
+
+// openedStmt counts a statement that was prepared on the connection.
+func openedStmt(conn *proxy.Conn) {
+	n := atomic.AddInt64(stmtCount(conn), 1)
+	labels := dbLabelSet(loadConnInfo(conn)).ToMap()
+	preparedOpen.With(labels).Inc()
+	preparedPerConnection.With(labels).Observe(float64(n))
+}
+
+// closedStmt counts a statement of the connection that was closed.
+func closedStmt(conn *proxy.Conn) {
+	atomic.AddInt64(stmtCount(conn), -1)
+	preparedOpen.With(dbLabelSet(loadConnInfo(conn)).ToMap()).Dec()
+}
+
+// forgetStmts drops the count of a connection that was closed, along with
+// whatever statements it left open.
+func forgetStmts(conn *proxy.Conn) {
+	n, ok := stmtCounts.LoadAndDelete(conn)
+	if !ok {
+		return
+	}
+
+	if left := atomic.LoadInt64(n.(*int64)); left > 0 {
+		labels := dbLabelSet(loadConnInfo(conn)).ToMap()
+		preparedOpen.With(labels).Sub(float64(left))
+	}
+}
+
+// preparedLabel is the prepared label of a statement of kind.
+func preparedLabel(kind string, prepared bool) string {
+	if kind == KindPrepare {
+		return ""
+	}
+
+	if prepared {
+		return "true"
+	}
+
+	return "false"
+}
+
+// fallback is an ad-hoc statement that the driver skipped, and thus that
+// database/sql prepares and executes instead.
+type fallback struct {
+	kind  string    // KindExec or KindQuery, of the skipped statement.
+	query string    // the query, to tell the prepare that follows.
+	start time.Time // of the skipped statement, the one the app ran.
+}
+
+// fallbacks maps a connection to the statement it skipped and, once that
+// is prepared, the prepared statement to it.
+var fallbacks sync.Map
+
+// skipped remembers the ad-hoc statement of dc, that the driver skipped.
+func skipped(conn *proxy.Conn, dc *dbCtx) {
+	fallbacks.Store(conn, &fallback{kind: dc.kind, query: dc.query, start: dc.start})
+}
+
+// fallbackOf returns the fallback that a statement of kind is part of, nil
+// if none. A connection runs a statement at a time, so the prepare that
+// follows a skipped statement, of the same query, is that of database/sql
+// and the execution that follows is the statement itself.
+func fallbackOf(stmt *proxy.Stmt, kind string) *fallback {
+	var key interface{} = stmt
+	if kind == KindPrepare {
+		key = stmt.Conn
+	}
+
+	f, ok := fallbacks.LoadAndDelete(key)
+	if !ok {
+		return nil
+	}
+
+	if kind == KindPrepare && f.(*fallback).query != stmt.QueryString {
+		return nil
+	}
+
+	return f.(*fallback)
+}
+
+// preparedFallback remembers that stmt was prepared for the fallback f.
+func preparedFallback(stmt *proxy.Stmt, f *fallback) {
+	fallbacks.Store(stmt, f)
+}
+
+// forgetFallback drops what is left of a fallback of a connection or of a
+// statement that was closed.
+func forgetFallback(key interface{}) {
+	fallbacks.Delete(key)
+}
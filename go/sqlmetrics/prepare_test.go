@@ -0,0 +1,65 @@
+package sqlmetrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+)
+
+func TestPrepare(t *testing.T) {
+	resetMetrics()
+	EnableSnapshots()
+	ctx := context.Background()
+
+	db := openFake(t, Options{}, func(q string) LabelSet {
+		return LabelSet{"per": q[:6]}
+	})
+	db.SetMaxOpenConns(1)
+
+	labels := dbLabelSet(&connInfo{dbName: "app", dbHost: "db.internal:5432"})
+	open := func() float64 {
+		return testutil.ToFloat64(preparedOpen.With(labels.ToMap()))
+	}
+
+	_, err := db.ExecContext(ctx, "UPDATE t SET n = 1")
+	assert.NilError(t, err)
+
+	stmt, err := db.PrepareContext(ctx, "UPDATE t SET n = $1")
+	assert.NilError(t, err)
+	assert.Equal(t, 1.0, open())
+
+	for i := 0; i < 2; i++ {
+		_, err = stmt.ExecContext(ctx, i)
+		assert.NilError(t, err)
+	}
+
+	assert.NilError(t, stmt.Close())
+	assert.Equal(t, 0.0, open())
+
+	_, err = db.PrepareContext(ctx, "SELECT unpreparable")
+	assert.ErrorContains(t, err, errFake.Error())
+	assert.Equal(t, 0.0, open())
+	assert.Equal(t, 1, testutil.CollectAndCount(preparedPerConnection))
+
+	counts := map[string]uint64{}
+	var failed uint64
+	for _, s := range Snapshot(time.Minute) {
+		counts[s.Labels["kind"]+"/"+s.Labels["prepared"]] += s.Count
+		failed += s.Errors
+	}
+
+	assert.DeepEqual(t, map[string]uint64{
+		"exec/false": 1, "exec/true": 2, "prepare/": 2,
+	}, counts)
+	assert.Equal(t, uint64(1), failed)
+
+	// the statements that a connection leaves open are counted out with it.
+	_, err = db.PrepareContext(ctx, "SELECT n FROM t")
+	assert.NilError(t, err)
+	assert.Equal(t, 1.0, open())
+	assert.NilError(t, db.Close())
+	assert.Equal(t, 0.0, open())
+}
@@ -0,0 +1,316 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/last9/last9-cdk/go/proc"
+	"github.com/prometheus/client_golang/prometheus"
+	proxy "github.com/shogo82148/go-sql-proxy"
+)
+
+var (
+	// rowLabels are the defaultLabels sans status and error_class, as only
+	// the statements that succeed have rows.
+	rowLabels = without(defaultLabels, "status", "error_class")
+
+	rowBuckets = prometheus.ExponentialBuckets(1, 10, 7) // 1 to 1M
+
+	sqlRowsAffected = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: prometheus.BuildFQName(
+				proc.Namespace,
+				subsystem,
+				"rows_affected",
+			),
+			Help:    "Rows affected per Exec",
+			Buckets: rowBuckets,
+		},
+		rowLabels,
+	)
+
+	sqlRowsReturned = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: prometheus.BuildFQName(
+				proc.Namespace,
+				subsystem,
+				"rows_returned",
+			),
+			Help:    "Rows read per Query, until its rows were closed",
+			Buckets: rowBuckets,
+		},
+		rowLabels,
+	)
+
+	// emitted as last9_sql_rows_duration_milliseconds and/or
+	// last9_sql_rows_duration_seconds, read SetDurationUnits.
+	sqlRowsDuration = proc.NewDurationHistogram(
+		proc.DurationHistogramOpts{
+			Namespace: proc.Namespace,
+			Subsystem: subsystem,
+			Name:      "rows_duration",
+			Help:      "SQL duration per Query, from its start until its rows were closed",
+		},
+		rowLabels,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sqlRowsAffected)
+	prometheus.MustRegister(sqlRowsReturned)
+	prometheus.MustRegister(sqlRowsDuration)
+}
+
+func without(keys []string, drop ...string) []string {
+	var out []string
+	for _, k := range keys {
+		var dropped bool
+		for _, d := range drop {
+			dropped = dropped || k == d
+		}
+
+		if !dropped {
+			out = append(out, k)
+		}
+	}
+
+	return out
+}
+
+// emitRowsAffected records the rows that an Exec affected, if the driver
+// knows.
+func emitRowsAffected(ls LabelSet, result driver.Result) {
+	if result == nil {
+		return
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+
+	sqlRowsAffected.With(makeLabels(ls, rowLabels).ToMap()).Observe(float64(n))
+}
+
+// The proxy's hooks see the driver.Rows of a Query but cannot replace it,
+// so the proxy is wrapped in turn: wrapDriver, wrapConnector, wrapConn and
+// wrapStmt wrap the Rows that their QueryContext returns in a countingRows.
+// PostQuery hands the query's labels over through a rowsHolder in the
+// context.
+type wrapDriver struct {
+	*proxy.Proxy
+}
+
+func (d wrapDriver) Open(name string) (driver.Conn, error) {
+	return wrapOpened(d.Proxy.Open(name))
+}
+
+// OpenConnector is what database/sql prefers over Open, as the proxy
+// implements driver.DriverContext.
+func (d wrapDriver) OpenConnector(name string) (driver.Connector, error) {
+	c, err := d.Proxy.OpenConnector(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wrapConnector{c, d}, nil
+}
+
+func wrapOpened(conn driver.Conn, err error) (driver.Conn, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return &wrapConn{conn.(*proxy.Conn)}, nil
+}
+
+type wrapConnector struct {
+	driver.Connector
+	driver wrapDriver
+}
+
+func (c *wrapConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return wrapOpened(c.Connector.Connect(ctx))
+}
+
+func (c *wrapConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Close closes the driver's connector, from DB.Close.
+func (c *wrapConnector) Close() error {
+	if cl, ok := c.Connector.(io.Closer); ok {
+		return cl.Close()
+	}
+
+	return nil
+}
+
+// wrapConn embeds the proxy's Conn, for every optional interface that it
+// implements to remain implemented.
+type wrapConn struct {
+	*proxy.Conn
+}
+
+func (c *wrapConn) PrepareContext(
+	ctx context.Context, query string,
+) (driver.Stmt, error) {
+	stmt, err := c.Conn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	openedStmt(c.Conn)
+	return &wrapStmt{stmt.(*proxy.Stmt)}, nil
+}
+
+func (c *wrapConn) QueryContext(
+	ctx context.Context, query string, args []driver.NamedValue,
+) (driver.Rows, error) {
+	h := &rowsHolder{}
+	rows, err := c.Conn.QueryContext(withRowsHolder(ctx, h), query, args)
+	return h.wrap(rows), err
+}
+
+type wrapStmt struct {
+	*proxy.Stmt
+}
+
+// Close counts the statement out, as the proxy has no hook for it.
+func (s *wrapStmt) Close() error {
+	closedStmt(s.Stmt.Conn)
+	forgetFallback(s.Stmt)
+	return s.Stmt.Close()
+}
+
+func (s *wrapStmt) QueryContext(
+	ctx context.Context, args []driver.NamedValue,
+) (driver.Rows, error) {
+	h := &rowsHolder{}
+	rows, err := s.Stmt.QueryContext(withRowsHolder(ctx, h), args)
+	return h.wrap(rows), err
+}
+
+type rowsHolderKey struct{}
+
+// rowsHolder carries the labels of a query, from PostQuery to wrapConn or
+// wrapStmt.
+type rowsHolder struct {
+	labels LabelSet
+	start  time.Time
+}
+
+func withRowsHolder(ctx context.Context, h *rowsHolder) context.Context {
+	return context.WithValue(ctx, rowsHolderKey{}, h)
+}
+
+func rowsHolderFrom(ctx context.Context) *rowsHolder {
+	h, _ := ctx.Value(rowsHolderKey{}).(*rowsHolder)
+	return h
+}
+
+// wrap returns rows as is, unless PostQuery filled the holder.
+func (h *rowsHolder) wrap(rows driver.Rows) driver.Rows {
+	if rows == nil || h.labels == nil {
+		return rows
+	}
+
+	return &countingRows{
+		Rows:   rows,
+		labels: makeLabels(h.labels, rowLabels).ToMap(),
+		start:  h.start,
+	}
+}
+
+// countingRows counts the rows read and records, upon Close, how many
+// they were and how long since the query started it took to get to them.
+// The optional interfaces of driver.Rows are passed through, with the
+// defaults that database/sql falls back to when the driver lacks them.
+type countingRows struct {
+	driver.Rows
+	labels map[string]string
+	start  time.Time
+	n      int
+	closed bool
+}
+
+func (r *countingRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err == nil {
+		r.n++
+	}
+
+	return err
+}
+
+func (r *countingRows) Close() error {
+	err := r.Rows.Close()
+	if !r.closed {
+		r.closed = true
+		sqlRowsReturned.With(r.labels).Observe(float64(r.n))
+		sqlRowsDuration.Observe(r.labels, time.Since(r.start))
+	}
+
+	return err
+}
+
+func (r *countingRows) HasNextResultSet() bool {
+	if rs, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return rs.HasNextResultSet()
+	}
+
+	return false
+}
+
+func (r *countingRows) NextResultSet() error {
+	if rs, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return rs.NextResultSet()
+	}
+
+	return io.EOF
+}
+
+func (r *countingRows) ColumnTypeScanType(index int) reflect.Type {
+	if rs, ok := r.Rows.(driver.RowsColumnTypeScanType); ok {
+		return rs.ColumnTypeScanType(index)
+	}
+
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+func (r *countingRows) ColumnTypeDatabaseTypeName(index int) string {
+	if rs, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return rs.ColumnTypeDatabaseTypeName(index)
+	}
+
+	return ""
+}
+
+func (r *countingRows) ColumnTypeLength(index int) (int64, bool) {
+	if rs, ok := r.Rows.(driver.RowsColumnTypeLength); ok {
+		return rs.ColumnTypeLength(index)
+	}
+
+	return 0, false
+}
+
+func (r *countingRows) ColumnTypeNullable(index int) (bool, bool) {
+	if rs, ok := r.Rows.(driver.RowsColumnTypeNullable); ok {
+		return rs.ColumnTypeNullable(index)
+	}
+
+	return false, false
+}
+
+func (r *countingRows) ColumnTypePrecisionScale(
+	index int,
+) (int64, int64, bool) {
+	if rs, ok := r.Rows.(driver.RowsColumnTypePrecisionScale); ok {
+		return rs.ColumnTypePrecisionScale(index)
+	}
+
+	return 0, 0, false
+}
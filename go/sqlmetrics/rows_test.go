@@ -0,0 +1,76 @@
+package sqlmetrics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"gotest.tools/assert"
+)
+
+// histogram returns the sample count and sum of a histogram's series.
+func histogram(
+	t *testing.T, h *prometheus.HistogramVec, ls LabelSet,
+) (uint64, float64) {
+	t.Helper()
+
+	labels := makeLabels(ls, rowLabels)
+	labels.Merge(LabelSet{"dbname": "app", "dbhost": "db.internal:5432"})
+
+	m := &dto.Metric{}
+	err := h.With(labels.ToMap()).(prometheus.Metric).Write(m)
+	assert.NilError(t, err)
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestRows(t *testing.T) {
+	resetMetrics()
+	ctx := context.Background()
+
+	db := openFake(t, Options{}, func(q string) LabelSet {
+		return LabelSet{"per": q[:6]}
+	})
+
+	// rows read to the end.
+	n, err := queryAll(ctx, db, "SELECT n FROM t")
+	assert.NilError(t, err)
+	assert.Equal(t, fakeRowCount, n)
+
+	// rows closed early, through a prepared statement.
+	stmt, err := db.PrepareContext(ctx, "SELECT n FROM t")
+	assert.NilError(t, err)
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx)
+	assert.NilError(t, err)
+	assert.Assert(t, rows.Next())
+	assert.NilError(t, rows.Close())
+
+	adhoc := LabelSet{"per": "SELECT", "kind": KindQuery, "prepared": "false"}
+	count, sum := histogram(t, sqlRowsReturned, adhoc)
+	assert.Equal(t, uint64(1), count)
+	assert.Equal(t, float64(fakeRowCount), sum)
+
+	prepared := LabelSet{"per": "SELECT", "kind": KindQuery, "prepared": "true"}
+	count, sum = histogram(t, sqlRowsReturned, prepared)
+	assert.Equal(t, uint64(1), count)
+	assert.Equal(t, float64(1), sum)
+	assert.Equal(t, 2, testutil.CollectAndCount(sqlRowsDuration))
+
+	// a failed query has no rows.
+	_, err = queryAll(ctx, db, "SELECT fail")
+	assert.ErrorContains(t, err, errFake.Error())
+	count, _ = histogram(t, sqlRowsReturned, adhoc)
+	assert.Equal(t, uint64(1), count)
+
+	_, err = db.ExecContext(ctx, "UPDATE t SET n = 1")
+	assert.NilError(t, err)
+
+	count, sum = histogram(t, sqlRowsAffected, LabelSet{
+		"per": "UPDATE", "kind": KindExec, "prepared": "false",
+	})
+	assert.Equal(t, uint64(1), count)
+	assert.Equal(t, float64(fakeRowCount), sum)
+}
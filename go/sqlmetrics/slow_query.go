@@ -0,0 +1,343 @@
+package sqlmetrics
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/last9/last9-cdk/go/proc"
+)
+
+const (
+	// DefaultSlowQueryThreshold is the Threshold of a SlowQueryLog that
+	// has none.
+	DefaultSlowQueryThreshold = time.Second
+
+	defaultSlowQueryMessage = "slow query"
+)
+
+// Redaction is how a SlowQueryLog writes the arguments of a statement.
+type Redaction int
+
+const (
+	// RedactTypes writes only the type of every argument, like int64.
+	RedactTypes Redaction = iota
+	// RedactHash writes a salted hash of every argument, for the same
+	// value to be told apart across lines without it being readable.
+	RedactHash
+	// RedactAllowlist writes the arguments of the Allow columns as they
+	// are, and the types of the rest.
+	RedactAllowlist
+)
+
+// SlowQueryLog emits a structured line per statement that takes longer
+// than a threshold, with its Fingerprint, duration, dbname, dbhost, the
+// labels of the LabelMaker and its arguments, redacted. A failure is told
+// by its error_class, never by the error's text, which may quote the very
+// values that were redacted. Lines are rate limited, so that a slow
+// database does not also flood the logs.
+// How to use?
+// slow := &sqlmetrics.SlowQueryLog{Threshold: 500 * time.Millisecond}
+// o := sqlmetrics.Options{Driver: "postgres", SlowQueries: slow}
+// sqlmetrics.RegisterDriverWithLabelMaker(o, sqlmetrics.FingerprintLabelMaker)
+type SlowQueryLog struct {
+	// Logger defaults to slog.Default()
+	Logger *slog.Logger
+
+	// Threshold defaults to DefaultSlowQueryThreshold. Thresholds override
+	// it per the per label of the LabelMaker.
+	Threshold  time.Duration
+	Thresholds map[string]time.Duration
+
+	// Redaction defaults to RedactTypes. Allow lists the columns whose
+	// arguments RedactAllowlist writes as they are. The column of a
+	// positional argument is read from the query, as in col = $1 or
+	// INSERT INTO t (col) VALUES (?), and that of a sql.Named one is its
+	// name.
+	Redaction Redaction
+	Allow     []string
+
+	// Salt keys the hashes of RedactHash, so that the low-entropy values,
+	// like IDs and emails, cannot be recovered with a dictionary. Defaults
+	// to a random one per process, set it for the hashes to match across
+	// processes. Keep it secret.
+	Salt []byte
+
+	// PerSecond is the rate of lines, 1 per second by default, that may
+	// burst up to Burst, which defaults to the rate.
+	PerSecond float64
+	Burst     int
+
+	// Level defaults to slog.LevelInfo and Message to "slow query"
+	Level   slog.Level
+	Message string
+
+	once    sync.Once
+	limiter *limiter
+	salt    []byte
+}
+
+// init sets up the limiter and the salt, on the first slow statement.
+func (s *SlowQueryLog) init() {
+	s.limiter = newLimiter(s.PerSecond, s.Burst)
+
+	s.salt = s.Salt
+	if len(s.salt) == 0 {
+		s.salt = make([]byte, 32)
+		if _, err := rand.Read(s.salt); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// threshold of a statement with the per label per.
+func (s *SlowQueryLog) threshold(per string) time.Duration {
+	if t, ok := s.Thresholds[per]; ok {
+		return t
+	}
+
+	if s.Threshold > 0 {
+		return s.Threshold
+	}
+
+	return DefaultSlowQueryThreshold
+}
+
+// log writes the line of a statement, if it was slow and the rate allows.
+func (s *SlowQueryLog) log(
+	c context.Context, query string, args []driver.NamedValue,
+	labels LabelSet, d time.Duration,
+) {
+	if d < s.threshold(labels["per"]) {
+		return
+	}
+
+	s.once.Do(s.init)
+
+	logger := s.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	level := s.Level
+	if c == nil {
+		c = context.Background()
+	}
+
+	if !logger.Enabled(c, level) || !s.limiter.allow(time.Now()) {
+		return
+	}
+
+	msg := s.Message
+	if msg == "" {
+		msg = defaultSlowQueryMessage
+	}
+
+	attrs := []slog.Attr{
+		slog.String("query", Fingerprint(query)),
+		slog.Duration("duration", d),
+	}
+
+	// the labels, in the order of defaultLabels, for the lines to read
+	// alike.
+	for _, l := range defaultLabels {
+		switch l {
+		case "status", proc.LabelHostname, proc.LabelProgram:
+			continue
+		}
+
+		if v := labels[l]; v != "" {
+			attrs = append(attrs, slog.String(l, v))
+		}
+	}
+
+	attrs = append(attrs, slog.Any("args", s.redact(query, args)))
+	logger.LogAttrs(c, level, msg, attrs...)
+}
+
+// redact returns the arguments as the Redaction would have them.
+func (s *SlowQueryLog) redact(query string, args []driver.NamedValue) []string {
+	var columns map[string]string
+	if s.Redaction == RedactAllowlist && len(args) > 0 {
+		columns = argColumns(tokenize(query))
+	}
+
+	out := make([]string, 0, len(args))
+	for _, a := range args {
+		switch s.Redaction {
+		case RedactHash:
+			mac := hmac.New(sha256.New, s.salt)
+			fmt.Fprintf(mac, "%T:%v", a.Value, a.Value)
+			out = append(out, "sha256:"+hex.EncodeToString(mac.Sum(nil)[:8]))
+			continue
+
+		case RedactAllowlist:
+			col := a.Name
+			if col == "" {
+				col = columns["$"+strconv.Itoa(a.Ordinal)]
+			}
+
+			if col != "" && s.allowed(col) {
+				out = append(out, fmt.Sprint(a.Value))
+				continue
+			}
+		}
+
+		out = append(out, fmt.Sprintf("%T", a.Value))
+	}
+
+	return out
+}
+
+func (s *SlowQueryLog) allowed(col string) bool {
+	for _, a := range s.Allow {
+		if strings.EqualFold(a, col) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// argColumns maps the params of a query, as $ordinal, to the columns that
+// they are compared to or inserted in to. The ? params are numbered in
+// order, the way the driver numbers their arguments.
+func argColumns(toks []token) map[string]string {
+	columns := map[string]string{}
+	ordinal := 0
+	var insertCols []string
+	tuple := -1 // the position in a VALUES tuple, -1 outside of one.
+	depth := 0  // of the parentheses within a VALUES tuple.
+
+	for i, t := range toks {
+		switch {
+		case tuple >= 0 && t.kind == tokPunct && t.text == "(":
+			depth++
+
+		case tuple >= 0 && t.kind == tokPunct && t.text == ")" && depth > 0:
+			depth--
+
+		case tuple >= 0 && depth > 0 && t.kind != tokParam:
+			// a function call in a tuple, like now().
+
+		case t.is("INTO") && i+2 < len(toks):
+			insertCols = nil
+			j := i + 1
+			for j < len(toks) && (isName(toks[j]) || toks[j].text == ".") {
+				j++
+			}
+
+			if j < len(toks) && toks[j].kind == tokPunct && toks[j].text == "(" {
+				for j++; j < len(toks) && toks[j].text != ")"; j++ {
+					if isName(toks[j]) {
+						insertCols = append(insertCols, toks[j].text)
+					}
+				}
+			}
+
+		case t.is("VALUES"):
+			tuple = -1
+
+		case t.kind == tokPunct && t.text == "(" && i > 0 &&
+			(toks[i-1].is("VALUES") || (toks[i-1].text == "," && tuple == -2)):
+			tuple = 0
+
+		case t.kind == tokPunct && t.text == "," && tuple >= 0:
+			tuple++
+
+		case t.kind == tokPunct && t.text == ")" && tuple >= 0:
+			tuple = -2 // in between the tuples of VALUES.
+
+		case t.kind == tokParam && !strings.HasPrefix(t.text, ":"):
+			key := t.text
+			if t.text == "?" {
+				ordinal++
+				key = "$" + strconv.Itoa(ordinal)
+			}
+
+			if col := paramColumn(toks, i, insertCols, tuple); col != "" {
+				columns[key] = col
+			}
+		}
+	}
+
+	return columns
+}
+
+// paramColumn finds the column of the param at i.
+func paramColumn(toks []token, i int, insertCols []string, tuple int) string {
+	if tuple >= 0 {
+		if tuple < len(insertCols) {
+			return insertCols[tuple]
+		}
+		return ""
+	}
+
+	// col = $1, col >= $1, col LIKE $1, col IN ($1, $2)
+	j := i - 1
+	for j >= 0 && (toks[j].kind == tokParam || (toks[j].kind == tokPunct &&
+		strings.Contains("=<>!,(", toks[j].text)) || toks[j].is("IN") ||
+		toks[j].is("LIKE") || toks[j].is("ILIKE") || toks[j].is("NOT")) {
+		j--
+	}
+
+	if j >= 0 && isName(toks[j]) {
+		return toks[j].text
+	}
+
+	return ""
+}
+
+// limiter is a token bucket.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(perSecond float64, burst int) *limiter {
+	if perSecond <= 0 {
+		perSecond = 1
+	}
+
+	b := float64(burst)
+	if b < 1 {
+		b = perSecond
+		if b < 1 {
+			b = 1
+		}
+	}
+
+	return &limiter{rate: perSecond, burst: b, tokens: b}
+}
+
+func (l *limiter) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
@@ -0,0 +1,141 @@
+package sqlmetrics
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// slowLines decodes the JSON lines that a SlowQueryLog wrote.
+func slowLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+
+	var out []map[string]interface{}
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if l == "" {
+			continue
+		}
+
+		m := map[string]interface{}{}
+		assert.NilError(t, json.Unmarshal([]byte(l), &m))
+		out = append(out, m)
+	}
+
+	buf.Reset()
+	return out
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	resetMetrics()
+	ctx := context.Background()
+
+	buf := &bytes.Buffer{}
+	slow := &SlowQueryLog{
+		Logger:     slog.New(slog.NewJSONHandler(buf, nil)),
+		Threshold:  time.Nanosecond,
+		Thresholds: map[string]time.Duration{"UPDATE t SET n = ?": time.Hour},
+		PerSecond:  1,
+		Burst:      3,
+	}
+
+	db := openFake(t, Options{SlowQueries: slow}, FingerprintLabelMaker)
+
+	q := "SELECT n FROM users WHERE email = $1 AND id = $2"
+	_, err := queryAll(ctx, db, q, "a@example.com", 7)
+	assert.NilError(t, err)
+
+	_, err = db.ExecContext(ctx, "UPDATE t SET n = 1")
+	assert.NilError(t, err)
+
+	lines := slowLines(t, buf)
+	assert.Equal(t, 1, len(lines))
+	l := lines[0]
+	assert.Equal(t, "slow query", l["msg"])
+	assert.Equal(t, "SELECT n FROM users WHERE email = ? AND id = ?", l["query"])
+	assert.Equal(t, "users", l["table"])
+	assert.Equal(t, "app", l["dbname"])
+	assert.Equal(t, "db.internal:5432", l["dbhost"])
+	assert.DeepEqual(t, []interface{}{"string", "int64"}, l["args"])
+
+	slow.Redaction = RedactAllowlist
+	slow.Allow = []string{"email"}
+	_, err = queryAll(ctx, db, q, "a@example.com", 7)
+	assert.NilError(t, err)
+	assert.DeepEqual(t,
+		[]interface{}{"a@example.com", "int64"}, slowLines(t, buf)[0]["args"],
+	)
+
+	// out of the burst, and failed.
+	slow.Redaction = RedactHash
+	for i := 0; i < 3; i++ {
+		_, err = db.ExecContext(ctx, "UPDATE fail SET n = $1", i)
+		assert.ErrorContains(t, err, errFake.Error())
+	}
+
+	lines = slowLines(t, buf)
+	assert.Equal(t, 1, len(lines))
+	assert.Equal(t, ClassifyError(errFake), lines[0]["error_class"])
+	_, hasError := lines[0]["error"]
+	assert.Assert(t, !hasError)
+	args := lines[0]["args"].([]interface{})
+	assert.Assert(t, strings.HasPrefix(args[0].(string), "sha256:"))
+}
+
+func TestRedactHash(t *testing.T) {
+	args := []driver.NamedValue{{Ordinal: 1, Value: "a@example.com"}}
+
+	hash := func(s *SlowQueryLog) string {
+		s.once.Do(s.init)
+		return s.redact("SELECT * FROM t WHERE email = $1", args)[0]
+	}
+
+	salted := hash(&SlowQueryLog{Redaction: RedactHash, Salt: []byte("pepper")})
+	assert.Equal(t, salted,
+		hash(&SlowQueryLog{Redaction: RedactHash, Salt: []byte("pepper")}))
+	assert.Assert(t, salted !=
+		hash(&SlowQueryLog{Redaction: RedactHash, Salt: []byte("other")}))
+
+	// not the plain sha256 of the value, that a dictionary would recover.
+	sum := sha256.Sum256([]byte("string:a@example.com"))
+	assert.Assert(t, salted != "sha256:"+hex.EncodeToString(sum[:8]))
+
+	// without a Salt, each process has one of its own.
+	assert.Assert(t, hash(&SlowQueryLog{Redaction: RedactHash}) !=
+		hash(&SlowQueryLog{Redaction: RedactHash}))
+}
+
+func TestArgColumns(t *testing.T) {
+	for q, expected := range map[string]map[string]string{
+		"SELECT * FROM t WHERE a = ? AND b >= ? AND c IN (?, ?)": {
+			"$1": "a", "$2": "b", "$3": "c", "$4": "c",
+		},
+		"UPDATE t SET a = $2 WHERE t.id = $1": {"$1": "id", "$2": "a"},
+		"INSERT INTO s.t (a, b, c) VALUES (?, now(), lower(?)), (?, ?, ?)": {
+			"$1": "a", "$2": "c", "$3": "a", "$4": "b", "$5": "c",
+		},
+		"INSERT INTO t (a) VALUES ($1) ON CONFLICT (a) DO UPDATE SET b = $2": {
+			"$1": "a", "$2": "b",
+		},
+	} {
+		assert.DeepEqual(t, expected, argColumns(tokenize(q)))
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(2, 1)
+	now := time.Now()
+
+	assert.Assert(t, l.allow(now))
+	assert.Assert(t, !l.allow(now))
+	assert.Assert(t, !l.allow(now.Add(100*time.Millisecond)))
+	assert.Assert(t, l.allow(now.Add(600*time.Millisecond)))
+}
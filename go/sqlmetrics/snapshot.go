@@ -0,0 +1,41 @@
+package sqlmetrics
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/last9/last9-cdk/go/proc"
+)
+
+// queryWindows mirrors sqlQueryDuration in-process, over a sliding window.
+// A status=failure is what counts as an error, and neither it nor the
+// error_class split a series.
+var queryWindows = proc.NewRollingSet(proc.RollingOptions{
+	Ignore: []string{"status", "error_class"},
+})
+
+// snapshots is set by EnableSnapshots. Until then queries are not
+// mirrored, as every label set costs a ring of slots of its own.
+var snapshots int32
+
+// EnableSnapshots starts mirroring queries in to the windows that
+// Snapshot reads.
+func EnableSnapshots() {
+	atomic.StoreInt32(&snapshots, 1)
+}
+
+// observeWindow mirrors a query, if snapshots were enabled.
+func observeWindow(labels map[string]string, d time.Duration, failed bool) {
+	if atomic.LoadInt32(&snapshots) == 1 {
+		queryWindows.Observe(labels, d, failed)
+	}
+}
+
+// Snapshot returns the rate, the ratio of failed queries and interpolated
+// latency quantiles of every label set that was queried in the window.
+// The window is rounded up to proc.DefaultRollingResolution and is capped
+// at proc.DefaultRollingSpan. It is empty unless EnableSnapshots was
+// called.
+func Snapshot(window time.Duration) []proc.LabeledSnapshot {
+	return queryWindows.Snapshot(window)
+}
@@ -5,18 +5,32 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"log"
+	"reflect"
+	"regexp"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	proxy "github.com/shogo82148/go-sql-proxy"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // enabled is a local registry that keeps a track of what has been enabled
-// and what hasn't been to avoid a re-initialization.
+// and what hasn't been to avoid a re-initialization. It maps a driver to
+// its registration.
 var enabled sync.Map
 
+// registration is the name that a driver was registered under, and the
+// Options and the label maker, a LabelMaker or a QueryLabelMaker, that it
+// was registered with.
+type registration struct {
+	name  string
+	opts  Options
+	maker interface{}
+}
+
 // driverName accepts the driver Identifier like :postgres, :mysql
 // and returns the last9 version of it, Which can be referred to later.
 // There is no magic in this function. The actual magic happens in RegisterDB
@@ -46,9 +60,15 @@ func isDriverEnabled(d string) bool {
 // The name is a misnomer but that's how the package owner had named it.
 // The attributes are self-explanatory and carry their own comments.
 type dbCtx struct {
-	start time.Time // time at which the pre-hook was executed.
-	query string    // the raw query string that was called.
-	// labels map[string]string //labelSet for this context
+	start  time.Time  // time at which the pre-hook was executed.
+	query  string     // the raw query string that was called.
+	kind   string     // one of KindExec, KindQuery and KindPrepare.
+	labels LabelSet   // labelSet for this context
+	span   trace.Span // nil, unless the statement runs within a trace.
+
+	// fallback is set on the prepare of a statement that the driver
+	// skipped, read fallback.
+	fallback *fallback
 }
 
 func getQueryStatus(err error) queryStatus {
@@ -66,9 +86,78 @@ func getQueryStatus(err error) queryStatus {
 // In such cases, if the library (outside your control) was using the driver
 // name as sql.Open(<driver>, dsn) then this struct would be
 // Options{Driver: <driver>, Override: true}
+//
+// TracerProvider starts a child span per statement, for the statements
+// that run within a trace. Defaults to the global one.
+//
+// SlowQueries logs the statements that take too long, none if nil.
+//
+// ErrorClassifier fills the error_class label of the statements that fail.
+// Defaults to ClassifyError.
 type Options struct {
 	Driver   string
 	Override bool
+
+	TracerProvider  trace.TracerProvider
+	SlowQueries     *SlowQueryLog
+	ErrorClassifier ErrorClassifier
+}
+
+// classify returns the error_class of err.
+func (r Options) classify(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	if r.ErrorClassifier != nil {
+		return r.ErrorClassifier(err)
+	}
+
+	return ClassifyError(err)
+}
+
+// same reports whether o is what r was registered with. Options holds
+// funcs and interfaces, hence is not comparable with ==.
+func (r Options) same(o Options) bool {
+	return r.Driver == o.Driver && r.Override == o.Override &&
+		r.SlowQueries == o.SlowQueries &&
+		sameValue(r.TracerProvider, o.TracerProvider) &&
+		sameValue(r.ErrorClassifier, o.ErrorClassifier)
+}
+
+// sameValue compares funcs by their code and the rest with ==, where the
+// type allows it. A closure or a method value is never the same as another
+// func, even one of the same code, as it may capture anything.
+func sameValue(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !va.IsValid() || !vb.IsValid() {
+		return va.IsValid() == vb.IsValid()
+	}
+
+	if va.Type() != vb.Type() {
+		return false
+	}
+
+	if va.Kind() == reflect.Func {
+		if va.IsNil() || vb.IsNil() {
+			return va.IsNil() == vb.IsNil()
+		}
+
+		return va.Pointer() == vb.Pointer() && !isClosure(va.Pointer())
+	}
+
+	return va.Type().Comparable() && a == b
+}
+
+// closureName is how the compiler names closures, like pkg.f.func1, and
+// method values, like pkg.T.M-fm.
+var closureName = regexp.MustCompile(`\.func\d+(\.\d+)*$|-fm$`)
+
+// isClosure reports whether the code at pc is that of a closure or a
+// method value, rather than of a function declared at the top level.
+func isClosure(pc uintptr) bool {
+	f := runtime.FuncForPC(pc)
+	return f == nil || closureName.MatchString(f.Name())
 }
 
 // DriverName returns the original or the suffixed driverName based on the
@@ -90,12 +179,58 @@ func RegisterDriver(d Options) (string, error) {
 // sync mechanics. But until we get to that, we can just skip it until then.
 
 func RegisterDriverWithLabelMaker(d Options, fn LabelMaker) (string, error) {
+	return registerOnce(d, fn, fn.ToQueryLabelMaker())
+}
+
+// RegisterDriverWithQueryLabelMaker is RegisterDriverWithLabelMaker, for
+// a QueryLabelMaker.
+//
+// Registering a driver again returns the name that it was registered
+// under, if the Options and the label maker are the same, and is an error
+// otherwise. Funcs, the label maker and the ErrorClassifier, are the same
+// only if they are the same function declared at the top level, like
+// FingerprintLabelMaker. A closure or a method value is never the same,
+// so registering again with one is always an error.
+func RegisterDriverWithQueryLabelMaker(
+	d Options, fn QueryLabelMaker,
+) (string, error) {
+	return registerOnce(d, fn, fn)
+}
+
+// registerOnce registers the driver of d, unless it was already. maker is
+// what fn was made of, for a registration that follows to compare with.
+func registerOnce(
+	d Options, maker interface{}, fn QueryLabelMaker,
+) (string, error) {
 	// If this is an already registered driver, don't do anything.
 	// SQL will take care of the registered driver for that database.
-	if x, ok := enabled.Load(d); ok {
-		return x.(string), nil
+	// Options other than those it was registered with cannot take effect,
+	// hence are an error rather than silently ignored.
+	if x, ok := enabled.Load(d.Driver); ok {
+		reg := x.(registration)
+		if !reg.opts.same(d) || !sameValue(reg.maker, maker) {
+			return "", errors.Errorf(
+				"%v is already registered as %v, with other options",
+				d.Driver, reg.name,
+			)
+		}
+
+		return reg.name, nil
+	}
+
+	name, err := register(d, fn, d.DriverName())
+	if err != nil {
+		return "", err
 	}
 
+	// mark this driver as enabled.
+	enabled.Store(d.Driver, registration{name: name, opts: d, maker: maker})
+	return name, nil
+}
+
+// register wraps the driver in a proxy, with the hooks that emit metrics,
+// and registers it under name.
+func register(d Options, fn QueryLabelMaker, name string) (string, error) {
 	if !isDriverEnabled(d.Driver) {
 		return "", errors.Errorf(
 			"%v has not been activated. Import it please", d)
@@ -109,46 +244,150 @@ func RegisterDriverWithLabelMaker(d Options, fn LabelMaker) (string, error) {
 		return "", errors.Wrapf(err, "init %v", d.Driver)
 	}
 
-	name := d.DriverName()
+	tracer := d.tracer()
+
+	// preStmt and postStmt are shared by the Exec, Query and Prepare hooks.
+	// postStmt returns the labels of the statement, nil if there are none.
+	preStmt := func(
+		c context.Context, stmt *proxy.Stmt, kind string,
+		args []driver.NamedValue,
+	) (interface{}, error) {
+		// the proxy prepares a Stmt of its own for the ad-hoc statements,
+		// one without the driver's.
+		prepared := kind != KindPrepare && stmt.Stmt != nil
+		dc := &dbCtx{start: time.Now(), query: stmt.QueryString, kind: kind}
+
+		// the prepare and the execution that stand in for a statement that
+		// the driver skipped are that statement, ad-hoc.
+		if f := fallbackOf(stmt, kind); f != nil {
+			if kind == KindPrepare {
+				dc.fallback = f
+			}
+
+			dc.kind, dc.start, prepared = f.kind, f.start, false
+		}
+
+		info := loadConnInfo(stmt.Conn)
+		qi := QueryInfo{
+			Context:  c,
+			Query:    stmt.QueryString,
+			Kind:     dc.kind,
+			Args:     args,
+			InTx:     inTx(stmt.Conn),
+			Prepared: prepared,
+		}
+
+		if info != nil {
+			qi.DBName, qi.DBHost = info.dbName, info.dbHost
+		}
+
+		dc.labels = LabelSet{}.Merge(fn(qi), labelsFrom(c))
+		dc.labels["kind"] = dc.kind
+		dc.labels["prepared"] = preparedLabel(dc.kind, prepared)
+		dc.span = startSpan(c, tracer, info, dc.labels)
+		return dc, nil
+	}
+
+	postStmt := func(
+		c context.Context, ctx interface{}, stmt *proxy.Stmt,
+		args []driver.NamedValue, err error,
+	) LabelSet {
+		if ctx == nil {
+			return nil
+		}
 
-	sql.Register(name, proxy.NewProxyContext(
-		//&wrapDriver{original: db.Driver()},
+		dc := ctx.(*dbCtx)
+
+		// the driver declined to run the statement ad-hoc, database/sql
+		// prepares and runs it instead and that is what gets recorded.
+		if errors.Is(err, driver.ErrSkip) {
+			endSpan(dc.span, nil)
+			if dc.kind != KindPrepare && stmt.Stmt == nil {
+				skipped(stmt.Conn, dc)
+			}
+			return nil
+		}
+
+		// the execution is yet to come, unless the prepare failed, in which
+		// case that is the failure of the statement.
+		if dc.fallback != nil && err == nil {
+			endSpan(dc.span, nil)
+			preparedFallback(stmt, dc.fallback)
+			return nil
+		}
+
+		endSpan(dc.span, err)
+		if dc.kind != KindPrepare {
+			countStatement(stmt.Conn)
+		}
+
+		labels := LabelSet{}.Merge(dc.labels, loadConnInfo(stmt.Conn).LabelSet())
+		labels["error_class"] = d.classify(err)
+		if err := emitDuration(
+			labels, getQueryStatus(err), dc.start,
+		); err != nil {
+			log.Printf("%+v", err)
+		}
+
+		if d.SlowQueries != nil {
+			d.SlowQueries.log(c, dc.query, args, labels, time.Since(dc.start))
+		}
+
+		return labels
+	}
+
+	sql.Register(name, wrapDriver{proxy.NewProxyContext(
 		db.Driver(),
 		&proxy.HooksContext{
 			PreOpen: func(c context.Context, dsn string) (interface{}, error) {
-				return dsn, nil
+				return &openCtx{dsn: dsn, start: time.Now()}, nil
 			},
 
 			PostOpen: func(
 				c context.Context, ctx interface{}, conn *proxy.Conn, err error,
 			) error {
-				dsn := ctx.(string)
-				storeConnInfo(conn, dsn)
+				oc := ctx.(*openCtx)
+				if err != nil || conn == nil {
+					failedOpen(oc.dsn, d.classify(err))
+					return nil
+				}
+
+				info, err := storeConnInfo(conn, oc.dsn)
+				if err != nil {
+					// not the error itself, which may well quote the DSN.
+					log.Printf("sqlmetrics: connection left unlabeled, its DSN does not parse")
+				}
+
+				openedConn(info, oc.start)
+				return nil
+			},
+
+			PrePrepare: func(
+				c context.Context, stmt *proxy.Stmt,
+			) (interface{}, error) {
+				return preStmt(c, stmt, KindPrepare, nil)
+			},
+
+			PostPrepare: func(
+				c context.Context, ctx interface{}, stmt *proxy.Stmt, err error,
+			) error {
+				postStmt(c, ctx, stmt, nil, err)
 				return nil
 			},
 
 			PreExec: func(
 				c context.Context, stmt *proxy.Stmt, args []driver.NamedValue,
 			) (interface{}, error) {
-				return &dbCtx{start: time.Now(), query: stmt.QueryString}, nil
+				return preStmt(c, stmt, KindExec, args)
 			},
 
 			PostExec: func(
 				c context.Context, ctx interface{}, stmt *proxy.Stmt,
 				args []driver.NamedValue, result driver.Result, err error,
 			) error {
-				if ctx == nil {
-					return nil
-				}
-
-				info := loadConnInfo(stmt.Conn)
-				dc := ctx.(*dbCtx)
-
-				if err := emitDuration(
-					fn(dc.query).Merge(
-						info.LabelSet()), getQueryStatus(err), dc.start,
-				); err != nil {
-					log.Printf("%+v", err)
+				labels := postStmt(c, ctx, stmt, args, err)
+				if labels != nil && err == nil {
+					emitRowsAffected(labels, result)
 				}
 				return nil
 			},
@@ -156,51 +395,56 @@ func RegisterDriverWithLabelMaker(d Options, fn LabelMaker) (string, error) {
 			PreQuery: func(
 				c context.Context, stmt *proxy.Stmt, args []driver.NamedValue,
 			) (interface{}, error) {
-				return &dbCtx{start: time.Now(), query: stmt.QueryString}, nil
+				return preStmt(c, stmt, KindQuery, args)
 			},
 
 			PostQuery: func(
 				c context.Context, ctx interface{}, stmt *proxy.Stmt,
 				args []driver.NamedValue, rows driver.Rows, err error,
 			) error {
-				if ctx == nil {
-					return nil
+				labels := postStmt(c, ctx, stmt, args, err)
+				if h := rowsHolderFrom(c); h != nil && labels != nil && err == nil {
+					h.labels = labels
+					h.start = ctx.(*dbCtx).start
 				}
-
-				info := loadConnInfo(stmt.Conn)
-				dc := ctx.(*dbCtx)
-
-				if err := emitDuration(
-					fn(dc.query).Merge(
-						info.LabelSet()), getQueryStatus(err), dc.start,
-				); err != nil {
-					log.Printf("%+v", err)
-				}
-
 				return nil
 			},
 
-			PreBegin: func(
-				c context.Context, conn *proxy.Conn,
-			) (interface{}, error) {
-				return nil, nil
+			PostBegin: func(
+				c context.Context, ctx interface{}, conn *proxy.Conn, err error,
+			) error {
+				if err == nil {
+					beginTx(conn, labelsFrom(c))
+				}
+				return nil
 			},
 
 			PostCommit: func(
 				c context.Context, ctx interface{}, tx *proxy.Tx, err error,
 			) error {
+				endTx(tx.Conn, outcomeCommit, err)
 				return nil
 			},
 
 			PostRollback: func(
 				c context.Context, ctx interface{}, tx *proxy.Tx, err error,
 			) error {
+				endTx(tx.Conn, outcomeRollback, err)
+				return nil
+			},
+
+			PostClose: func(
+				c context.Context, ctx interface{}, conn *proxy.Conn, err error,
+			) error {
+				forgetTx(conn)
+				forgetStmts(conn)
+				forgetFallback(conn)
+				closedConn(loadConnInfo(conn))
+				deleteConnInfo(conn)
 				return nil
 			},
 		},
-	))
+	)})
 
-	// mark this driver as enabled.
-	enabled.Store(d.Driver, name)
 	return name, nil
 }
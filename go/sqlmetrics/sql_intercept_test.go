@@ -0,0 +1,163 @@
+package sqlmetrics
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"gotest.tools/assert"
+)
+
+func TestRegisterDriver(t *testing.T) {
+	resetMetrics()
+
+	// a driver of its own, as RegisterDriver registers <driver>:last9
+	// globally and for good.
+	const base = "fakedb-registered"
+	if !isDriverEnabled(base) {
+		sql.Register(base, fakeDriver{})
+	}
+
+	o := Options{Driver: base, ErrorClassifier: ClassifyError}
+
+	name, err := RegisterDriver(o)
+	assert.NilError(t, err)
+	assert.Equal(t, base+":last9", name)
+
+	// again, with the same options, is the same driver.
+	name, err = RegisterDriver(o)
+	assert.NilError(t, err)
+	assert.Equal(t, base+":last9", name)
+
+	db, err := sql.Open(name, fakeDSN)
+	assert.NilError(t, err)
+	defer db.Close()
+
+	_, err = db.ExecContext(context.Background(), "UPDATE t SET n = 1")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, testutil.CollectAndCount(sqlQueryDuration))
+
+	// with other options, it is an error rather than them being ignored.
+	tp := sdktrace.NewTracerProvider()
+	defer func() { _ = tp.Shutdown(context.Background()) }()
+
+	for _, other := range []Options{
+		{Driver: base, Override: true, ErrorClassifier: ClassifyError},
+		{Driver: base},
+		{Driver: base, ErrorClassifier: func(error) string { return "" }},
+		{Driver: base, ErrorClassifier: ClassifyError, SlowQueries: &SlowQueryLog{}},
+		{Driver: base, ErrorClassifier: ClassifyError, TracerProvider: tp},
+	} {
+		_, err := RegisterDriver(other)
+		assert.ErrorContains(t, err, "with other options")
+	}
+
+	// as is another label maker, or a closure even if of the same code.
+	_, err = RegisterDriverWithLabelMaker(o, FingerprintLabelMaker)
+	assert.ErrorContains(t, err, "with other options")
+	_, err = RegisterDriverWithLabelMaker(o, func(q string) LabelSet {
+		return defaultLabelMaker(q)
+	})
+	assert.ErrorContains(t, err, "with other options")
+
+	name, err = RegisterDriverWithLabelMaker(o, defaultLabelMaker)
+	assert.NilError(t, err)
+	assert.Equal(t, base+":last9", name)
+}
+
+func TestSameValue(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	defer func() { _ = tp.Shutdown(context.Background()) }()
+
+	assert.Assert(t, sameValue(nil, nil))
+	assert.Assert(t, sameValue(tp, tp))
+	assert.Assert(t, !sameValue(tp, nil))
+	assert.Assert(t, sameValue(ErrorClassifier(ClassifyError), ErrorClassifier(ClassifyError)))
+	assert.Assert(t, sameValue(ErrorClassifier(nil), ErrorClassifier(nil)))
+	assert.Assert(t, !sameValue(ErrorClassifier(ClassifyError), ErrorClassifier(nil)))
+
+	// nor is a closure, as what it captures may differ.
+	classifier := func(class string) ErrorClassifier {
+		return func(error) string { return class }
+	}
+	f := classifier("a")
+	assert.Assert(t, !sameValue(f, f))
+	assert.Assert(t, !sameValue(classifier("a"), classifier("b")))
+	assert.Assert(t, !sameValue(ErrorClassifier(Options{}.classify), ErrorClassifier(Options{}.classify)))
+
+	// an uncomparable type is never the same, rather than a panic.
+	assert.Assert(t, !sameValue([]error{errors.New("x")}, []error{errors.New("x")}))
+}
+
+func TestErrSkip(t *testing.T) {
+	resetMetrics()
+	EnableSnapshots()
+	ctx := context.Background()
+
+	buf := &bytes.Buffer{}
+	slow := &SlowQueryLog{
+		Logger:    slog.New(slog.NewJSONHandler(buf, nil)),
+		Threshold: time.Nanosecond,
+		PerSecond: 100,
+		Burst:     100,
+	}
+
+	db := openFake(t, Options{SlowQueries: slow}, func(q string) LabelSet {
+		return LabelSet{"per": q[:6]}
+	})
+
+	// the driver skips both, database/sql prepares and runs them instead.
+	tx, err := db.BeginTx(ctx, nil)
+	assert.NilError(t, err)
+	_, err = tx.ExecContext(ctx, "UPDATE t SET n = 1 -- skip")
+	assert.NilError(t, err)
+	n, err := queryAll(ctx, tx, "SELECT n FROM t -- skip")
+	assert.NilError(t, err)
+	assert.Equal(t, fakeRowCount, n)
+	assert.NilError(t, tx.Commit())
+
+	// not a failure, anywhere, nor a prepare and a prepared execution.
+	counts := map[string]uint64{}
+	for _, s := range Snapshot(time.Minute) {
+		assert.Equal(t, uint64(0), s.Errors, s.Labels)
+		assert.Equal(t, "", s.Labels["error_class"], s.Labels)
+		counts[s.Labels["kind"]+"/"+s.Labels["prepared"]] += s.Count
+	}
+
+	assert.DeepEqual(t, map[string]uint64{"exec/false": 1, "query/false": 1}, counts)
+
+	lines := slowLines(t, buf)
+	assert.Equal(t, 2, len(lines))
+	for _, l := range lines {
+		_, ok := l["error_class"]
+		assert.Assert(t, !ok, l)
+		assert.Equal(t, "false", l["prepared"])
+	}
+
+	// and two statements of the transaction, not four.
+	labels := dbLabelSet(&connInfo{dbName: "app", dbHost: "db.internal:5432"})
+	labels["outcome"] = outcomeCommit
+	m := &dto.Metric{}
+	err = sqlTxStatements.With(labels.ToMap()).(prometheus.Metric).Write(m)
+	assert.NilError(t, err)
+	assert.Equal(t, 2.0, m.GetHistogram().GetSampleSum())
+
+	// a prepare that fails is the failure of the ad-hoc statement.
+	resetMetrics()
+	_, err = db.ExecContext(ctx, "UPDATE unpreparable SET n = 1 -- skip")
+	assert.ErrorContains(t, err, errFake.Error())
+
+	snaps := Snapshot(time.Minute)
+	assert.Equal(t, 1, len(snaps))
+	assert.Equal(t, uint64(1), snaps[0].Errors)
+	assert.Equal(t, KindExec, snaps[0].Labels["kind"])
+	assert.Equal(t, "false", snaps[0].Labels["prepared"])
+}
@@ -0,0 +1,72 @@
+package sqlmetrics
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/last9/last9-cdk/go/sqlmetrics"
+
+// tracer defaults to the global provider, which is a no-op until the
+// application sets one with otel.SetTracerProvider.
+func (r Options) tracer() trace.Tracer {
+	if r.TracerProvider != nil {
+		return r.TracerProvider.Tracer(tracerName)
+	}
+
+	return otel.Tracer(tracerName)
+}
+
+// startSpan starts a client span for a statement, named after the per
+// label of the LabelMaker rather than the raw query. Statements that run
+// outside of a trace, without a span in their context, are not traced.
+func startSpan(
+	c context.Context, t trace.Tracer, info *connInfo, ls LabelSet,
+) trace.Span {
+	if !trace.SpanContextFromContext(c).IsValid() {
+		return nil
+	}
+
+	name := ls["per"]
+	if name == "" {
+		name = "sql"
+	}
+
+	attrs := []attribute.KeyValue{}
+	if info != nil {
+		attrs = append(attrs,
+			attribute.String("db.system", info.system),
+			attribute.String("db.name", info.dbName),
+			attribute.String("server.address", info.address),
+		)
+
+		if info.port > 0 {
+			attrs = append(attrs, attribute.Int("server.port", info.port))
+		}
+	}
+
+	_, span := t.Start(c, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+
+	return span
+}
+
+// endSpan ends the span, if one was started, recording the error if any.
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
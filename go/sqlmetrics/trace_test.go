@@ -0,0 +1,69 @@
+package sqlmetrics
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gotest.tools/assert"
+)
+
+func TestTrace(t *testing.T) {
+	resetMetrics()
+
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	defer func() { _ = tp.Shutdown(context.Background()) }()
+
+	db := openFake(t, Options{TracerProvider: tp}, func(q string) LabelSet {
+		return LabelSet{"per": q[:6]}
+	})
+
+	// outside of a trace, nothing is traced.
+	if _, err := db.Exec("UPDATE users SET x = 1"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(exp.GetSpans()))
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "handler")
+	if _, err := db.ExecContext(ctx, "UPDATE users SET x = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := queryAll(ctx, db, "SELECT n FROM t")
+	assert.NilError(t, err)
+	assert.Equal(t, fakeRowCount, n)
+
+	_, err = queryAll(ctx, db, "DELETE fail")
+	assert.ErrorContains(t, err, errFake.Error())
+	parent.End()
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, s := range exp.GetSpans() {
+		spans[s.Name] = s
+	}
+
+	for _, name := range []string{"UPDATE", "SELECT", "DELETE"} {
+		s, ok := spans[name]
+		assert.Assert(t, ok, name)
+		assert.Equal(t, trace.SpanKindClient, s.SpanKind)
+		assert.Equal(t, parent.SpanContext().SpanID(), s.Parent.SpanID())
+
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, a := range s.Attributes {
+			attrs[a.Key] = a.Value
+		}
+
+		assert.Equal(t, "postgres", attrs["db.system"].AsString())
+		assert.Equal(t, "app", attrs["db.name"].AsString())
+		assert.Equal(t, "db.internal", attrs["server.address"].AsString())
+		assert.Equal(t, int64(5432), attrs["server.port"].AsInt64())
+	}
+
+	assert.Equal(t, codes.Unset, spans["SELECT"].Status.Code)
+	assert.Equal(t, codes.Error, spans["DELETE"].Status.Code)
+}
@@ -0,0 +1,138 @@
+package sqlmetrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/last9/last9-cdk/go/proc"
+	"github.com/prometheus/client_golang/prometheus"
+	proxy "github.com/shogo82148/go-sql-proxy"
+)
+
+const (
+	outcomeCommit   = "commit"
+	outcomeRollback = "rollback"
+)
+
+var (
+	txLabels = append([]string{"outcome"}, dbLabels...)
+
+	// emitted as last9_sql_transaction_duration_milliseconds and/or
+	// last9_sql_transaction_duration_seconds, read SetDurationUnits.
+	sqlTxDuration = proc.NewDurationHistogram(
+		proc.DurationHistogramOpts{
+			Namespace: proc.Namespace,
+			Subsystem: subsystem,
+			Name:      "transaction_duration",
+			Help:      "SQL transaction duration, from begin to commit or rollback",
+		},
+		txLabels,
+	)
+
+	sqlTxTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prometheus.BuildFQName(
+				proc.Namespace,
+				subsystem,
+				"transactions_total",
+			),
+			Help: "SQL transactions per outcome, commit or rollback",
+		},
+		txLabels,
+	)
+
+	sqlTxCommitFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prometheus.BuildFQName(
+				proc.Namespace,
+				subsystem,
+				"transaction_commit_failures_total",
+			),
+			Help: "SQL transactions whose commit failed",
+		},
+		dbLabels,
+	)
+
+	sqlTxStatements = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: prometheus.BuildFQName(
+				proc.Namespace,
+				subsystem,
+				"transaction_statements",
+			),
+			Help:    "SQL statements per transaction",
+			Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+		},
+		txLabels,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sqlTxDuration)
+	prometheus.MustRegister(sqlTxTotal)
+	prometheus.MustRegister(sqlTxCommitFailures)
+	prometheus.MustRegister(sqlTxStatements)
+}
+
+// txState is the transaction in progress on a connection. PreBegin's
+// return value is not handed to PostCommit, so the state is kept per
+// connection, which has at most one transaction at a time.
+type txState struct {
+	start      time.Time
+	statements uint64   // atomic
+	labels     LabelSet // of the context that began it.
+}
+
+var txMap sync.Map
+
+func beginTx(conn *proxy.Conn, labels LabelSet) {
+	txMap.Store(conn, &txState{start: time.Now(), labels: labels})
+}
+
+// countStatement counts a statement against the connection's transaction,
+// if it is in one.
+func countStatement(conn *proxy.Conn) {
+	if st, ok := txMap.Load(conn); ok {
+		atomic.AddUint64(&st.(*txState).statements, 1)
+	}
+}
+
+// inTx tells whether the connection is in a transaction.
+func inTx(conn *proxy.Conn) bool {
+	_, ok := txMap.Load(conn)
+	return ok
+}
+
+// endTx emits the metrics of the transaction on the connection, if any.
+func endTx(conn *proxy.Conn, outcome string, err error) {
+	st, ok := txMap.LoadAndDelete(conn)
+	if !ok {
+		return
+	}
+
+	tx := st.(*txState)
+	labels := dbLabelSet(loadConnInfo(conn))
+	for k, v := range tx.labels {
+		if _, ok := labels[k]; ok && v != "" {
+			labels[k] = v
+		}
+	}
+
+	if outcome == outcomeCommit && err != nil {
+		sqlTxCommitFailures.With(labels.ToMap()).Inc()
+	}
+
+	labels["outcome"] = outcome
+	sqlTxDuration.Observe(labels.ToMap(), time.Since(tx.start))
+	sqlTxTotal.With(labels.ToMap()).Inc()
+	sqlTxStatements.With(labels.ToMap()).Observe(
+		float64(atomic.LoadUint64(&tx.statements)),
+	)
+}
+
+// forgetTx drops the state of a transaction that was never finished, as
+// its connection was closed.
+func forgetTx(conn *proxy.Conn) {
+	txMap.Delete(conn)
+}
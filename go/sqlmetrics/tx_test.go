@@ -0,0 +1,56 @@
+package sqlmetrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+)
+
+func TestTransactions(t *testing.T) {
+	resetMetrics()
+	db := openFake(t, Options{}, defaultLabelMaker)
+
+	// commit, with two statements.
+	tx, err := db.Begin()
+	assert.NilError(t, err)
+	_, err = tx.Exec("UPDATE a SET x = 1")
+	assert.NilError(t, err)
+	_, err = tx.Exec("UPDATE b SET x = 1")
+	assert.NilError(t, err)
+	assert.NilError(t, tx.Commit())
+
+	// rollback, with one.
+	tx, err = db.Begin()
+	assert.NilError(t, err)
+	_, err = tx.Exec("UPDATE a SET x = 2")
+	assert.NilError(t, err)
+	assert.NilError(t, tx.Rollback())
+
+	// a failed commit.
+	tx, err = db.Begin()
+	assert.NilError(t, err)
+	_, err = tx.Exec("UPDATE poison SET x = 3")
+	assert.NilError(t, err)
+	assert.ErrorContains(t, tx.Commit(), errFake.Error())
+
+	// statements outside of a transaction are not counted against one.
+	_, err = db.Exec("UPDATE a SET x = 4")
+	assert.NilError(t, err)
+
+	labels := dbLabelSet(&connInfo{dbName: "app", dbHost: "db.internal:5432"})
+	assert.Equal(t, 1.0, testutil.ToFloat64(sqlTxCommitFailures.With(labels.ToMap())))
+
+	labels["outcome"] = outcomeCommit
+	assert.Equal(t, 2.0, testutil.ToFloat64(sqlTxTotal.With(labels.ToMap())))
+	labels["outcome"] = outcomeRollback
+	assert.Equal(t, 1.0, testutil.ToFloat64(sqlTxTotal.With(labels.ToMap())))
+
+	// a series per outcome.
+	assert.Equal(t, 2, testutil.CollectAndCount(sqlTxStatements))
+	assert.Equal(t, 2, testutil.CollectAndCount(sqlTxDuration))
+
+	n := 0
+	txMap.Range(func(k, v interface{}) bool { n++; return true })
+	assert.Equal(t, 0, n)
+}